@@ -1,5 +1,99 @@
 package api
 
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Websocket protocol
+
+// ProtocolVersion is the version of the websocket protocol, messages of other versions are rejected
+const ProtocolVersion = 1
+
+// Every websocket message is wrapped into an Envelope, Type tells what Payload is.
+// Seq numbers messages sent by one side of the connection, starting from 1.
+type Envelope struct {
+	Type    string          `json:"type"`
+	Version int             `json:"version"`
+	Seq     uint64          `json:"seq"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// Envelope types
+const (
+	// both directions
+	TypeHello = "hello"
+
+	// Client -> Worker
+	TypeNew         = "new"          // ClientMessage starting a request
+	TypeTestSuite   = "test_suite"   // TestSuite, right after "new" for test targets
+	TypeSourceFiles = "source_files" // ClientMessage with source files
+	TypeStop        = "stop"         // ClientMessage stopping the running request
+
+	// Worker -> Client
+	TypeCapabilities  = "capabilities"
+	TypeAccepted      = "accepted"
+	TypeStageEvent    = "stage_event"
+	TypeOutput        = "output"
+	TypeOutputDropped = "output_dropped"
+	TypeExitCode      = "exit_code"
+	TypeDuration      = "duration"
+	TypeResourceUsage = "resource_usage"
+	TypeTestResult    = "test_result"
+	TypeError         = "error"
+	TypeFinish        = "finish"
+	TypeDraining      = "draining"
+)
+
+// The first message of both sides: the worker lists protocol versions it supports,
+// the client answers with a hello of the version it picked
+type Hello struct {
+	Versions []int `json:"versions"`
+}
+
+// MessageType returns the envelope type of a message sent by the worker, empty if it's unknown
+func MessageType(msg interface{}) string {
+	switch msg.(type) {
+	case Hello:
+		return TypeHello
+	case Capabilities:
+		return TypeCapabilities
+	case Draining:
+		return TypeDraining
+	case Accepted:
+		return TypeAccepted
+	case StageEvent:
+		return TypeStageEvent
+	case Output:
+		return TypeOutput
+	case OutputDropped:
+		return TypeOutputDropped
+	case ExitCode:
+		return TypeExitCode
+	case Duration:
+		return TypeDuration
+	case ResourceUsage:
+		return TypeResourceUsage
+	case TestResult:
+		return TypeTestResult
+	case Error:
+		return TypeError
+	case Finish:
+		return TypeFinish
+	}
+	return ""
+}
+
+// NewEnvelope wraps the message into an envelope of the current protocol version
+func NewEnvelope(msgType string, seq uint64, msg interface{}) (Envelope, error) {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return Envelope{}, fmt.Errorf("failed to marshal %s message: %w", msgType, err)
+	}
+	return Envelope{Type: msgType, Version: ProtocolVersion, Seq: seq, Payload: payload}, nil
+}
+
 // Client -> Backend
 type SourceFile struct {
 	Name string `json:"name"`
@@ -9,10 +103,23 @@ type SourceFile struct {
 
 type ClientMessage struct {
 	SourceFiles []SourceFile `json:"source_files"`
-	Command     string       `json:"command"`
 	RequestID   string       `json:"request_id"`
 	// name of a target stage, ex: "run_tests"
 	Target string `json:"target"`
+	// name of a build env, ex: "cpp-generic", can be omitted if the worker has only one
+	BuildEnv string `json:"build_env,omitempty"`
+	// "new" messages are signed if the worker is configured with a request secret:
+	// hex HMAC-SHA256 of request_id, build_env, target, timestamp (unix seconds) and sources_hash joined with new lines.
+	// sources_hash is hex SHA-256 of "<name>\n<hex SHA-256 of the text>\n" of every source file in order,
+	// the source_files message must match it.
+	Timestamp   int64  `json:"timestamp,omitempty"`
+	Signature   string `json:"signature,omitempty"`
+	SourcesHash string `json:"sources_hash,omitempty"`
+	// who submitted the request, ex: a user id, written to the audit log
+	Requester string `json:"requester,omitempty"`
+	// W3C trace context of the client, spans of the request continue its trace
+	TraceParent string `json:"traceparent,omitempty"`
+	TraceState  string `json:"tracestate,omitempty"`
 }
 
 type TestCheck struct {
@@ -31,13 +138,58 @@ type TestCase struct {
 type TestSuite struct {
 	InitTestCases []TestCase `json:"init_test_cases"`
 	TestCases     []TestCase `json:"test_cases"`
+	// test cases stop at the first failing one unless it's set
+	RunAllTestCases bool `json:"run_all_test_cases,omitempty"`
 }
 
 // Backend -> Client
 
+type BuildEnv struct {
+	Name    string   `json:"name"`
+	Targets []string `json:"targets"`
+}
+
+// Sent when the worker is shutting down: it doesn't take new requests and closes the connection
+// once the running one finishes or is stopped
+type Draining struct {
+	TimeLeftSec float64 `json:"time_left_sec"` // the running request is stopped after that
+}
+
+// Sent once right after connecting to the backend
+type Capabilities struct {
+	BuildEnvs  []BuildEnv `json:"build_envs"`
+	CheckTypes []string   `json:"check_types"` // types of test case checks the worker understands
+	// limits for source files of a request
+	MaxSourcesSizeBytes   uint64 `json:"max_sources_size_bytes"` // all files together
+	MaxSourceFileNameSize int    `json:"max_source_file_name_size"`
+}
+
+type Limits struct {
+	AddressSpaceMb  uint64  `json:"address_space_mb"`
+	RunTimeSec      float32 `json:"run_time_sec"`
+	FileDescriptors uint64  `json:"file_descriptors"`
+	FileWritesMb    uint64  `json:"file_writes_mb"`
+	Threads         uint64  `json:"threads"`
+	OutputBytes     uint64  `json:"output_bytes"`
+}
+
+type AcceptedStage struct {
+	Name   string `json:"name"`
+	Limits Limits `json:"limits"`
+}
+
+// Sent once a "new" request is accepted, otherwise the worker sends Error and Finish.
+// Stages are listed in the order of dependencies, the test suite must be sent before source files if it's expected.
+type Accepted struct {
+	Stages            []AcceptedStage `json:"stages"`
+	TestSuiteExpected bool            `json:"test_suite_expected"`
+	RequestID         string          `json:"request_id"`
+}
+
 // Possible events:
 // "started" - start of a stage
 // "finished" - stage ended
+// "skipped" - stage wasn't run because some previous stage failed
 type StageEvent struct {
 	Event     string `json:"event"`
 	Stage     string `json:"stage"`
@@ -57,6 +209,14 @@ type Duration struct {
 	RequestID   string  `json:"request_id"`
 }
 
+// Resources used by the stage's process and its children
+type ResourceUsage struct {
+	MaxRSSKb   int64   `json:"max_rss_kb"`
+	CPUTimeSec float64 `json:"cpu_time_sec"` // user + system
+	Stage      string  `json:"stage"`
+	RequestID  string  `json:"request_id"`
+}
+
 type Output struct {
 	Text      string `json:"output"` // base64 encoded
 	Type      string `json:"type"`
@@ -64,6 +224,13 @@ type Output struct {
 	RequestID string `json:"request_id"`
 }
 
+// Sent after the stage's output if the client was too slow to take all of it and the rest was dropped
+type OutputDropped struct {
+	DroppedBytes uint64 `json:"dropped_bytes"`
+	Stage        string `json:"stage"`
+	RequestID    string `json:"request_id"`
+}
+
 type TestResult struct {
 	TestCase  string `json:"test_case"` // index of a test case being run (if applied)
 	Result    bool   `json:"result"`
@@ -82,3 +249,72 @@ type Finish struct {
 	Finish    bool   `json:"finish"`
 	RequestID string `json:"request_id"`
 }
+
+// HTTP API
+
+// Source files have plain (not base64 encoded) texts, hashes aren't needed
+type ExecuteRequest struct {
+	RequestID   string       `json:"request_id,omitempty"`
+	BuildEnv    string       `json:"build_env,omitempty"`
+	Target      string       `json:"target"`
+	SourceFiles []SourceFile `json:"source_files"`
+	TestSuite   *TestSuite   `json:"test_suite,omitempty"`
+	// who submitted the request, ex: a user id, written to the audit log
+	Requester string `json:"requester,omitempty"`
+	// signed the same way as the "new" message if the worker is configured with a request secret,
+	// sources_hash is computed from source_files
+	Timestamp int64  `json:"timestamp,omitempty"`
+	Signature string `json:"signature,omitempty"`
+}
+
+// Result of a single stage run, stages of test targets have one result per test case
+type StageResult struct {
+	Stage           string  `json:"stage"`
+	TestCase        string  `json:"test_case,omitempty"`
+	Skipped         bool    `json:"skipped,omitempty"`
+	ExitCode        *int    `json:"exit_code,omitempty"` // not set if the stage was skipped or failed to start
+	DurationSec     float64 `json:"duration_sec"`
+	MaxRSSKb        int64   `json:"max_rss_kb,omitempty"`
+	CPUTimeSec      float64 `json:"cpu_time_sec,omitempty"`
+	Stdout          string  `json:"stdout"`
+	Stderr          string  `json:"stderr"`
+	OutputTruncated bool    `json:"output_truncated,omitempty"` // output is truncated to the stage's output limit
+}
+
+type ExecuteResponse struct {
+	RequestID   string        `json:"request_id"`
+	Success     bool          `json:"success"` // every stage and test case succeeded
+	Stages      []StageResult `json:"stages"`
+	TestResults []TestResult  `json:"test_results"`
+	Errors      []Error       `json:"errors"`
+}
+
+type JobRequest struct {
+	ExecuteRequest
+	// the finished Job is POSTed there
+	WebhookURL string `json:"webhook_url,omitempty"`
+}
+
+// Possible job statuses:
+// "queued" - waiting for the worker to take it
+// "running"
+// "completed" - finished, see Result
+// "cancelled" - cancelled by a client
+// "failed" - couldn't be run at all, see Error
+type Job struct {
+	ID         string           `json:"job_id"`
+	Status     string           `json:"status"`
+	Error      string           `json:"error,omitempty"`
+	CreatedAt  time.Time        `json:"created_at"`
+	StartedAt  *time.Time       `json:"started_at,omitempty"`
+	FinishedAt *time.Time       `json:"finished_at,omitempty"`
+	Result     *ExecuteResponse `json:"result,omitempty"`
+}
+
+// All messages sent for the job as envelopes, the same ones a websocket client gets
+type JobEvents struct {
+	ID     string     `json:"job_id"`
+	Events []Envelope `json:"events"`
+	// output messages which weren't kept as the job had too many events, the result still has the output
+	DroppedEvents int `json:"dropped_events,omitempty"`
+}
@@ -0,0 +1,4 @@
+// Package workerpb is generated from worker.proto
+package workerpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative worker.proto
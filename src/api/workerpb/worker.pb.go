@@ -0,0 +1,1701 @@
+// gRPC version of the worker protocol, messages mirror JSON ones from the api package.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11
+// 	protoc        (unknown)
+// source: worker.proto
+
+package workerpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type GetCapabilitiesRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetCapabilitiesRequest) Reset() {
+	*x = GetCapabilitiesRequest{}
+	mi := &file_worker_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetCapabilitiesRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetCapabilitiesRequest) ProtoMessage() {}
+
+func (x *GetCapabilitiesRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_worker_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetCapabilitiesRequest.ProtoReflect.Descriptor instead.
+func (*GetCapabilitiesRequest) Descriptor() ([]byte, []int) {
+	return file_worker_proto_rawDescGZIP(), []int{0}
+}
+
+type BuildEnv struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Name          string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Targets       []string               `protobuf:"bytes,2,rep,name=targets,proto3" json:"targets,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *BuildEnv) Reset() {
+	*x = BuildEnv{}
+	mi := &file_worker_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BuildEnv) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BuildEnv) ProtoMessage() {}
+
+func (x *BuildEnv) ProtoReflect() protoreflect.Message {
+	mi := &file_worker_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BuildEnv.ProtoReflect.Descriptor instead.
+func (*BuildEnv) Descriptor() ([]byte, []int) {
+	return file_worker_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *BuildEnv) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *BuildEnv) GetTargets() []string {
+	if x != nil {
+		return x.Targets
+	}
+	return nil
+}
+
+type Capabilities struct {
+	state     protoimpl.MessageState `protogen:"open.v1"`
+	BuildEnvs []*BuildEnv            `protobuf:"bytes,1,rep,name=build_envs,json=buildEnvs,proto3" json:"build_envs,omitempty"`
+	// types of test case checks the worker understands
+	CheckTypes []string `protobuf:"bytes,2,rep,name=check_types,json=checkTypes,proto3" json:"check_types,omitempty"`
+	// limits for source files of a request
+	MaxSourcesSizeBytes   uint64 `protobuf:"varint,3,opt,name=max_sources_size_bytes,json=maxSourcesSizeBytes,proto3" json:"max_sources_size_bytes,omitempty"`
+	MaxSourceFileNameSize int32  `protobuf:"varint,4,opt,name=max_source_file_name_size,json=maxSourceFileNameSize,proto3" json:"max_source_file_name_size,omitempty"`
+	unknownFields         protoimpl.UnknownFields
+	sizeCache             protoimpl.SizeCache
+}
+
+func (x *Capabilities) Reset() {
+	*x = Capabilities{}
+	mi := &file_worker_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Capabilities) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Capabilities) ProtoMessage() {}
+
+func (x *Capabilities) ProtoReflect() protoreflect.Message {
+	mi := &file_worker_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Capabilities.ProtoReflect.Descriptor instead.
+func (*Capabilities) Descriptor() ([]byte, []int) {
+	return file_worker_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *Capabilities) GetBuildEnvs() []*BuildEnv {
+	if x != nil {
+		return x.BuildEnvs
+	}
+	return nil
+}
+
+func (x *Capabilities) GetCheckTypes() []string {
+	if x != nil {
+		return x.CheckTypes
+	}
+	return nil
+}
+
+func (x *Capabilities) GetMaxSourcesSizeBytes() uint64 {
+	if x != nil {
+		return x.MaxSourcesSizeBytes
+	}
+	return 0
+}
+
+func (x *Capabilities) GetMaxSourceFileNameSize() int32 {
+	if x != nil {
+		return x.MaxSourceFileNameSize
+	}
+	return 0
+}
+
+type SourceFile struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Name          string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Text          []byte                 `protobuf:"bytes,2,opt,name=text,proto3" json:"text,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SourceFile) Reset() {
+	*x = SourceFile{}
+	mi := &file_worker_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SourceFile) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SourceFile) ProtoMessage() {}
+
+func (x *SourceFile) ProtoReflect() protoreflect.Message {
+	mi := &file_worker_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SourceFile.ProtoReflect.Descriptor instead.
+func (*SourceFile) Descriptor() ([]byte, []int) {
+	return file_worker_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *SourceFile) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *SourceFile) GetText() []byte {
+	if x != nil {
+		return x.Text
+	}
+	return nil
+}
+
+type TestCheck struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Type          string                 `protobuf:"bytes,1,opt,name=type,proto3" json:"type,omitempty"`
+	Arg           string                 `protobuf:"bytes,2,opt,name=arg,proto3" json:"arg,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *TestCheck) Reset() {
+	*x = TestCheck{}
+	mi := &file_worker_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *TestCheck) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TestCheck) ProtoMessage() {}
+
+func (x *TestCheck) ProtoReflect() protoreflect.Message {
+	mi := &file_worker_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TestCheck.ProtoReflect.Descriptor instead.
+func (*TestCheck) Descriptor() ([]byte, []int) {
+	return file_worker_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *TestCheck) GetType() string {
+	if x != nil {
+		return x.Type
+	}
+	return ""
+}
+
+func (x *TestCheck) GetArg() string {
+	if x != nil {
+		return x.Arg
+	}
+	return ""
+}
+
+type TestCase struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Description   string                 `protobuf:"bytes,1,opt,name=description,proto3" json:"description,omitempty"`
+	Checks        []*TestCheck           `protobuf:"bytes,2,rep,name=checks,proto3" json:"checks,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *TestCase) Reset() {
+	*x = TestCase{}
+	mi := &file_worker_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *TestCase) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TestCase) ProtoMessage() {}
+
+func (x *TestCase) ProtoReflect() protoreflect.Message {
+	mi := &file_worker_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TestCase.ProtoReflect.Descriptor instead.
+func (*TestCase) Descriptor() ([]byte, []int) {
+	return file_worker_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *TestCase) GetDescription() string {
+	if x != nil {
+		return x.Description
+	}
+	return ""
+}
+
+func (x *TestCase) GetChecks() []*TestCheck {
+	if x != nil {
+		return x.Checks
+	}
+	return nil
+}
+
+type TestSuite struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	InitTestCases []*TestCase            `protobuf:"bytes,1,rep,name=init_test_cases,json=initTestCases,proto3" json:"init_test_cases,omitempty"`
+	TestCases     []*TestCase            `protobuf:"bytes,2,rep,name=test_cases,json=testCases,proto3" json:"test_cases,omitempty"`
+	// test cases stop at the first failing one unless it's set
+	RunAllTestCases bool `protobuf:"varint,3,opt,name=run_all_test_cases,json=runAllTestCases,proto3" json:"run_all_test_cases,omitempty"`
+	unknownFields   protoimpl.UnknownFields
+	sizeCache       protoimpl.SizeCache
+}
+
+func (x *TestSuite) Reset() {
+	*x = TestSuite{}
+	mi := &file_worker_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *TestSuite) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TestSuite) ProtoMessage() {}
+
+func (x *TestSuite) ProtoReflect() protoreflect.Message {
+	mi := &file_worker_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TestSuite.ProtoReflect.Descriptor instead.
+func (*TestSuite) Descriptor() ([]byte, []int) {
+	return file_worker_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *TestSuite) GetInitTestCases() []*TestCase {
+	if x != nil {
+		return x.InitTestCases
+	}
+	return nil
+}
+
+func (x *TestSuite) GetTestCases() []*TestCase {
+	if x != nil {
+		return x.TestCases
+	}
+	return nil
+}
+
+func (x *TestSuite) GetRunAllTestCases() bool {
+	if x != nil {
+		return x.RunAllTestCases
+	}
+	return false
+}
+
+type ExecuteRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// generated by the worker if empty
+	RequestId string `protobuf:"bytes,1,opt,name=request_id,json=requestId,proto3" json:"request_id,omitempty"`
+	// can be omitted if the worker has only one
+	BuildEnv string `protobuf:"bytes,2,opt,name=build_env,json=buildEnv,proto3" json:"build_env,omitempty"`
+	// name of a target stage, ex: "run_tests"
+	Target      string        `protobuf:"bytes,3,opt,name=target,proto3" json:"target,omitempty"`
+	SourceFiles []*SourceFile `protobuf:"bytes,4,rep,name=source_files,json=sourceFiles,proto3" json:"source_files,omitempty"`
+	// required for test targets
+	TestSuite *TestSuite `protobuf:"bytes,5,opt,name=test_suite,json=testSuite,proto3" json:"test_suite,omitempty"`
+	// who submitted the request, ex: a user id, written to the audit log
+	Requester string `protobuf:"bytes,6,opt,name=requester,proto3" json:"requester,omitempty"`
+	// unix seconds and signature, required if the worker is configured with a request secret,
+	// see the readme for what is signed
+	Timestamp     int64  `protobuf:"varint,7,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	Signature     string `protobuf:"bytes,8,opt,name=signature,proto3" json:"signature,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ExecuteRequest) Reset() {
+	*x = ExecuteRequest{}
+	mi := &file_worker_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ExecuteRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ExecuteRequest) ProtoMessage() {}
+
+func (x *ExecuteRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_worker_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ExecuteRequest.ProtoReflect.Descriptor instead.
+func (*ExecuteRequest) Descriptor() ([]byte, []int) {
+	return file_worker_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *ExecuteRequest) GetRequestId() string {
+	if x != nil {
+		return x.RequestId
+	}
+	return ""
+}
+
+func (x *ExecuteRequest) GetBuildEnv() string {
+	if x != nil {
+		return x.BuildEnv
+	}
+	return ""
+}
+
+func (x *ExecuteRequest) GetTarget() string {
+	if x != nil {
+		return x.Target
+	}
+	return ""
+}
+
+func (x *ExecuteRequest) GetSourceFiles() []*SourceFile {
+	if x != nil {
+		return x.SourceFiles
+	}
+	return nil
+}
+
+func (x *ExecuteRequest) GetTestSuite() *TestSuite {
+	if x != nil {
+		return x.TestSuite
+	}
+	return nil
+}
+
+func (x *ExecuteRequest) GetRequester() string {
+	if x != nil {
+		return x.Requester
+	}
+	return ""
+}
+
+func (x *ExecuteRequest) GetTimestamp() int64 {
+	if x != nil {
+		return x.Timestamp
+	}
+	return 0
+}
+
+func (x *ExecuteRequest) GetSignature() string {
+	if x != nil {
+		return x.Signature
+	}
+	return ""
+}
+
+type StopRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	RequestId     string                 `protobuf:"bytes,1,opt,name=request_id,json=requestId,proto3" json:"request_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StopRequest) Reset() {
+	*x = StopRequest{}
+	mi := &file_worker_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StopRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StopRequest) ProtoMessage() {}
+
+func (x *StopRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_worker_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StopRequest.ProtoReflect.Descriptor instead.
+func (*StopRequest) Descriptor() ([]byte, []int) {
+	return file_worker_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *StopRequest) GetRequestId() string {
+	if x != nil {
+		return x.RequestId
+	}
+	return ""
+}
+
+type StopResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StopResponse) Reset() {
+	*x = StopResponse{}
+	mi := &file_worker_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StopResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StopResponse) ProtoMessage() {}
+
+func (x *StopResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_worker_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StopResponse.ProtoReflect.Descriptor instead.
+func (*StopResponse) Descriptor() ([]byte, []int) {
+	return file_worker_proto_rawDescGZIP(), []int{9}
+}
+
+type Limits struct {
+	state           protoimpl.MessageState `protogen:"open.v1"`
+	AddressSpaceMb  uint64                 `protobuf:"varint,1,opt,name=address_space_mb,json=addressSpaceMb,proto3" json:"address_space_mb,omitempty"`
+	RunTimeSec      float32                `protobuf:"fixed32,2,opt,name=run_time_sec,json=runTimeSec,proto3" json:"run_time_sec,omitempty"`
+	FileDescriptors uint64                 `protobuf:"varint,3,opt,name=file_descriptors,json=fileDescriptors,proto3" json:"file_descriptors,omitempty"`
+	FileWritesMb    uint64                 `protobuf:"varint,4,opt,name=file_writes_mb,json=fileWritesMb,proto3" json:"file_writes_mb,omitempty"`
+	Threads         uint64                 `protobuf:"varint,5,opt,name=threads,proto3" json:"threads,omitempty"`
+	OutputBytes     uint64                 `protobuf:"varint,6,opt,name=output_bytes,json=outputBytes,proto3" json:"output_bytes,omitempty"`
+	unknownFields   protoimpl.UnknownFields
+	sizeCache       protoimpl.SizeCache
+}
+
+func (x *Limits) Reset() {
+	*x = Limits{}
+	mi := &file_worker_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Limits) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Limits) ProtoMessage() {}
+
+func (x *Limits) ProtoReflect() protoreflect.Message {
+	mi := &file_worker_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Limits.ProtoReflect.Descriptor instead.
+func (*Limits) Descriptor() ([]byte, []int) {
+	return file_worker_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *Limits) GetAddressSpaceMb() uint64 {
+	if x != nil {
+		return x.AddressSpaceMb
+	}
+	return 0
+}
+
+func (x *Limits) GetRunTimeSec() float32 {
+	if x != nil {
+		return x.RunTimeSec
+	}
+	return 0
+}
+
+func (x *Limits) GetFileDescriptors() uint64 {
+	if x != nil {
+		return x.FileDescriptors
+	}
+	return 0
+}
+
+func (x *Limits) GetFileWritesMb() uint64 {
+	if x != nil {
+		return x.FileWritesMb
+	}
+	return 0
+}
+
+func (x *Limits) GetThreads() uint64 {
+	if x != nil {
+		return x.Threads
+	}
+	return 0
+}
+
+func (x *Limits) GetOutputBytes() uint64 {
+	if x != nil {
+		return x.OutputBytes
+	}
+	return 0
+}
+
+type AcceptedStage struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Name          string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Limits        *Limits                `protobuf:"bytes,2,opt,name=limits,proto3" json:"limits,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AcceptedStage) Reset() {
+	*x = AcceptedStage{}
+	mi := &file_worker_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AcceptedStage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AcceptedStage) ProtoMessage() {}
+
+func (x *AcceptedStage) ProtoReflect() protoreflect.Message {
+	mi := &file_worker_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AcceptedStage.ProtoReflect.Descriptor instead.
+func (*AcceptedStage) Descriptor() ([]byte, []int) {
+	return file_worker_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *AcceptedStage) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *AcceptedStage) GetLimits() *Limits {
+	if x != nil {
+		return x.Limits
+	}
+	return nil
+}
+
+// The first event, stages are listed in the order of dependencies
+type Accepted struct {
+	state             protoimpl.MessageState `protogen:"open.v1"`
+	Stages            []*AcceptedStage       `protobuf:"bytes,1,rep,name=stages,proto3" json:"stages,omitempty"`
+	TestSuiteExpected bool                   `protobuf:"varint,2,opt,name=test_suite_expected,json=testSuiteExpected,proto3" json:"test_suite_expected,omitempty"`
+	unknownFields     protoimpl.UnknownFields
+	sizeCache         protoimpl.SizeCache
+}
+
+func (x *Accepted) Reset() {
+	*x = Accepted{}
+	mi := &file_worker_proto_msgTypes[12]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Accepted) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Accepted) ProtoMessage() {}
+
+func (x *Accepted) ProtoReflect() protoreflect.Message {
+	mi := &file_worker_proto_msgTypes[12]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Accepted.ProtoReflect.Descriptor instead.
+func (*Accepted) Descriptor() ([]byte, []int) {
+	return file_worker_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *Accepted) GetStages() []*AcceptedStage {
+	if x != nil {
+		return x.Stages
+	}
+	return nil
+}
+
+func (x *Accepted) GetTestSuiteExpected() bool {
+	if x != nil {
+		return x.TestSuiteExpected
+	}
+	return false
+}
+
+// Possible events: "started", "finished", "skipped"
+type StageEvent struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Event         string                 `protobuf:"bytes,1,opt,name=event,proto3" json:"event,omitempty"`
+	Stage         string                 `protobuf:"bytes,2,opt,name=stage,proto3" json:"stage,omitempty"`
+	TestCase      string                 `protobuf:"bytes,3,opt,name=test_case,json=testCase,proto3" json:"test_case,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StageEvent) Reset() {
+	*x = StageEvent{}
+	mi := &file_worker_proto_msgTypes[13]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StageEvent) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StageEvent) ProtoMessage() {}
+
+func (x *StageEvent) ProtoReflect() protoreflect.Message {
+	mi := &file_worker_proto_msgTypes[13]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StageEvent.ProtoReflect.Descriptor instead.
+func (*StageEvent) Descriptor() ([]byte, []int) {
+	return file_worker_proto_rawDescGZIP(), []int{13}
+}
+
+func (x *StageEvent) GetEvent() string {
+	if x != nil {
+		return x.Event
+	}
+	return ""
+}
+
+func (x *StageEvent) GetStage() string {
+	if x != nil {
+		return x.Stage
+	}
+	return ""
+}
+
+func (x *StageEvent) GetTestCase() string {
+	if x != nil {
+		return x.TestCase
+	}
+	return ""
+}
+
+type Output struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Text  []byte                 `protobuf:"bytes,1,opt,name=text,proto3" json:"text,omitempty"`
+	// "stdout" or "stderr"
+	Type          string `protobuf:"bytes,2,opt,name=type,proto3" json:"type,omitempty"`
+	Stage         string `protobuf:"bytes,3,opt,name=stage,proto3" json:"stage,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Output) Reset() {
+	*x = Output{}
+	mi := &file_worker_proto_msgTypes[14]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Output) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Output) ProtoMessage() {}
+
+func (x *Output) ProtoReflect() protoreflect.Message {
+	mi := &file_worker_proto_msgTypes[14]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Output.ProtoReflect.Descriptor instead.
+func (*Output) Descriptor() ([]byte, []int) {
+	return file_worker_proto_rawDescGZIP(), []int{14}
+}
+
+func (x *Output) GetText() []byte {
+	if x != nil {
+		return x.Text
+	}
+	return nil
+}
+
+func (x *Output) GetType() string {
+	if x != nil {
+		return x.Type
+	}
+	return ""
+}
+
+func (x *Output) GetStage() string {
+	if x != nil {
+		return x.Stage
+	}
+	return ""
+}
+
+type ExitCode struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	ExitCode      int32                  `protobuf:"varint,1,opt,name=exit_code,json=exitCode,proto3" json:"exit_code,omitempty"`
+	Stage         string                 `protobuf:"bytes,2,opt,name=stage,proto3" json:"stage,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ExitCode) Reset() {
+	*x = ExitCode{}
+	mi := &file_worker_proto_msgTypes[15]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ExitCode) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ExitCode) ProtoMessage() {}
+
+func (x *ExitCode) ProtoReflect() protoreflect.Message {
+	mi := &file_worker_proto_msgTypes[15]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ExitCode.ProtoReflect.Descriptor instead.
+func (*ExitCode) Descriptor() ([]byte, []int) {
+	return file_worker_proto_rawDescGZIP(), []int{15}
+}
+
+func (x *ExitCode) GetExitCode() int32 {
+	if x != nil {
+		return x.ExitCode
+	}
+	return 0
+}
+
+func (x *ExitCode) GetStage() string {
+	if x != nil {
+		return x.Stage
+	}
+	return ""
+}
+
+type Duration struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	DurationSec   float64                `protobuf:"fixed64,1,opt,name=duration_sec,json=durationSec,proto3" json:"duration_sec,omitempty"`
+	Stage         string                 `protobuf:"bytes,2,opt,name=stage,proto3" json:"stage,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Duration) Reset() {
+	*x = Duration{}
+	mi := &file_worker_proto_msgTypes[16]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Duration) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Duration) ProtoMessage() {}
+
+func (x *Duration) ProtoReflect() protoreflect.Message {
+	mi := &file_worker_proto_msgTypes[16]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Duration.ProtoReflect.Descriptor instead.
+func (*Duration) Descriptor() ([]byte, []int) {
+	return file_worker_proto_rawDescGZIP(), []int{16}
+}
+
+func (x *Duration) GetDurationSec() float64 {
+	if x != nil {
+		return x.DurationSec
+	}
+	return 0
+}
+
+func (x *Duration) GetStage() string {
+	if x != nil {
+		return x.Stage
+	}
+	return ""
+}
+
+type ResourceUsage struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	MaxRssKb      int64                  `protobuf:"varint,1,opt,name=max_rss_kb,json=maxRssKb,proto3" json:"max_rss_kb,omitempty"`
+	CpuTimeSec    float64                `protobuf:"fixed64,2,opt,name=cpu_time_sec,json=cpuTimeSec,proto3" json:"cpu_time_sec,omitempty"`
+	Stage         string                 `protobuf:"bytes,3,opt,name=stage,proto3" json:"stage,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ResourceUsage) Reset() {
+	*x = ResourceUsage{}
+	mi := &file_worker_proto_msgTypes[17]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ResourceUsage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ResourceUsage) ProtoMessage() {}
+
+func (x *ResourceUsage) ProtoReflect() protoreflect.Message {
+	mi := &file_worker_proto_msgTypes[17]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ResourceUsage.ProtoReflect.Descriptor instead.
+func (*ResourceUsage) Descriptor() ([]byte, []int) {
+	return file_worker_proto_rawDescGZIP(), []int{17}
+}
+
+func (x *ResourceUsage) GetMaxRssKb() int64 {
+	if x != nil {
+		return x.MaxRssKb
+	}
+	return 0
+}
+
+func (x *ResourceUsage) GetCpuTimeSec() float64 {
+	if x != nil {
+		return x.CpuTimeSec
+	}
+	return 0
+}
+
+func (x *ResourceUsage) GetStage() string {
+	if x != nil {
+		return x.Stage
+	}
+	return ""
+}
+
+type TestResult struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	TestCase      string                 `protobuf:"bytes,1,opt,name=test_case,json=testCase,proto3" json:"test_case,omitempty"`
+	Result        bool                   `protobuf:"varint,2,opt,name=result,proto3" json:"result,omitempty"`
+	Stage         string                 `protobuf:"bytes,3,opt,name=stage,proto3" json:"stage,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *TestResult) Reset() {
+	*x = TestResult{}
+	mi := &file_worker_proto_msgTypes[18]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *TestResult) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TestResult) ProtoMessage() {}
+
+func (x *TestResult) ProtoReflect() protoreflect.Message {
+	mi := &file_worker_proto_msgTypes[18]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TestResult.ProtoReflect.Descriptor instead.
+func (*TestResult) Descriptor() ([]byte, []int) {
+	return file_worker_proto_rawDescGZIP(), []int{18}
+}
+
+func (x *TestResult) GetTestCase() string {
+	if x != nil {
+		return x.TestCase
+	}
+	return ""
+}
+
+func (x *TestResult) GetResult() bool {
+	if x != nil {
+		return x.Result
+	}
+	return false
+}
+
+func (x *TestResult) GetStage() string {
+	if x != nil {
+		return x.Stage
+	}
+	return ""
+}
+
+// Sent after the stage's output if the client was too slow to take all of it and the rest was dropped
+type OutputDropped struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	DroppedBytes  uint64                 `protobuf:"varint,1,opt,name=dropped_bytes,json=droppedBytes,proto3" json:"dropped_bytes,omitempty"`
+	Stage         string                 `protobuf:"bytes,2,opt,name=stage,proto3" json:"stage,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *OutputDropped) Reset() {
+	*x = OutputDropped{}
+	mi := &file_worker_proto_msgTypes[19]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *OutputDropped) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*OutputDropped) ProtoMessage() {}
+
+func (x *OutputDropped) ProtoReflect() protoreflect.Message {
+	mi := &file_worker_proto_msgTypes[19]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use OutputDropped.ProtoReflect.Descriptor instead.
+func (*OutputDropped) Descriptor() ([]byte, []int) {
+	return file_worker_proto_rawDescGZIP(), []int{19}
+}
+
+func (x *OutputDropped) GetDroppedBytes() uint64 {
+	if x != nil {
+		return x.DroppedBytes
+	}
+	return 0
+}
+
+func (x *OutputDropped) GetStage() string {
+	if x != nil {
+		return x.Stage
+	}
+	return ""
+}
+
+type Error struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Description   string                 `protobuf:"bytes,1,opt,name=description,proto3" json:"description,omitempty"`
+	Stage         string                 `protobuf:"bytes,2,opt,name=stage,proto3" json:"stage,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Error) Reset() {
+	*x = Error{}
+	mi := &file_worker_proto_msgTypes[20]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Error) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Error) ProtoMessage() {}
+
+func (x *Error) ProtoReflect() protoreflect.Message {
+	mi := &file_worker_proto_msgTypes[20]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Error.ProtoReflect.Descriptor instead.
+func (*Error) Descriptor() ([]byte, []int) {
+	return file_worker_proto_rawDescGZIP(), []int{20}
+}
+
+func (x *Error) GetDescription() string {
+	if x != nil {
+		return x.Description
+	}
+	return ""
+}
+
+func (x *Error) GetStage() string {
+	if x != nil {
+		return x.Stage
+	}
+	return ""
+}
+
+type Finish struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Finish) Reset() {
+	*x = Finish{}
+	mi := &file_worker_proto_msgTypes[21]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Finish) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Finish) ProtoMessage() {}
+
+func (x *Finish) ProtoReflect() protoreflect.Message {
+	mi := &file_worker_proto_msgTypes[21]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Finish.ProtoReflect.Descriptor instead.
+func (*Finish) Descriptor() ([]byte, []int) {
+	return file_worker_proto_rawDescGZIP(), []int{21}
+}
+
+type Event struct {
+	state     protoimpl.MessageState `protogen:"open.v1"`
+	RequestId string                 `protobuf:"bytes,1,opt,name=request_id,json=requestId,proto3" json:"request_id,omitempty"`
+	// Types that are valid to be assigned to Event:
+	//
+	//	*Event_StageEvent
+	//	*Event_Output
+	//	*Event_ExitCode
+	//	*Event_Duration
+	//	*Event_ResourceUsage
+	//	*Event_TestResult
+	//	*Event_Error
+	//	*Event_Finish
+	//	*Event_Accepted
+	//	*Event_OutputDropped
+	Event         isEvent_Event `protobuf_oneof:"event"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Event) Reset() {
+	*x = Event{}
+	mi := &file_worker_proto_msgTypes[22]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Event) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Event) ProtoMessage() {}
+
+func (x *Event) ProtoReflect() protoreflect.Message {
+	mi := &file_worker_proto_msgTypes[22]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Event.ProtoReflect.Descriptor instead.
+func (*Event) Descriptor() ([]byte, []int) {
+	return file_worker_proto_rawDescGZIP(), []int{22}
+}
+
+func (x *Event) GetRequestId() string {
+	if x != nil {
+		return x.RequestId
+	}
+	return ""
+}
+
+func (x *Event) GetEvent() isEvent_Event {
+	if x != nil {
+		return x.Event
+	}
+	return nil
+}
+
+func (x *Event) GetStageEvent() *StageEvent {
+	if x != nil {
+		if x, ok := x.Event.(*Event_StageEvent); ok {
+			return x.StageEvent
+		}
+	}
+	return nil
+}
+
+func (x *Event) GetOutput() *Output {
+	if x != nil {
+		if x, ok := x.Event.(*Event_Output); ok {
+			return x.Output
+		}
+	}
+	return nil
+}
+
+func (x *Event) GetExitCode() *ExitCode {
+	if x != nil {
+		if x, ok := x.Event.(*Event_ExitCode); ok {
+			return x.ExitCode
+		}
+	}
+	return nil
+}
+
+func (x *Event) GetDuration() *Duration {
+	if x != nil {
+		if x, ok := x.Event.(*Event_Duration); ok {
+			return x.Duration
+		}
+	}
+	return nil
+}
+
+func (x *Event) GetResourceUsage() *ResourceUsage {
+	if x != nil {
+		if x, ok := x.Event.(*Event_ResourceUsage); ok {
+			return x.ResourceUsage
+		}
+	}
+	return nil
+}
+
+func (x *Event) GetTestResult() *TestResult {
+	if x != nil {
+		if x, ok := x.Event.(*Event_TestResult); ok {
+			return x.TestResult
+		}
+	}
+	return nil
+}
+
+func (x *Event) GetError() *Error {
+	if x != nil {
+		if x, ok := x.Event.(*Event_Error); ok {
+			return x.Error
+		}
+	}
+	return nil
+}
+
+func (x *Event) GetFinish() *Finish {
+	if x != nil {
+		if x, ok := x.Event.(*Event_Finish); ok {
+			return x.Finish
+		}
+	}
+	return nil
+}
+
+func (x *Event) GetAccepted() *Accepted {
+	if x != nil {
+		if x, ok := x.Event.(*Event_Accepted); ok {
+			return x.Accepted
+		}
+	}
+	return nil
+}
+
+func (x *Event) GetOutputDropped() *OutputDropped {
+	if x != nil {
+		if x, ok := x.Event.(*Event_OutputDropped); ok {
+			return x.OutputDropped
+		}
+	}
+	return nil
+}
+
+type isEvent_Event interface {
+	isEvent_Event()
+}
+
+type Event_StageEvent struct {
+	StageEvent *StageEvent `protobuf:"bytes,2,opt,name=stage_event,json=stageEvent,proto3,oneof"`
+}
+
+type Event_Output struct {
+	Output *Output `protobuf:"bytes,3,opt,name=output,proto3,oneof"`
+}
+
+type Event_ExitCode struct {
+	ExitCode *ExitCode `protobuf:"bytes,4,opt,name=exit_code,json=exitCode,proto3,oneof"`
+}
+
+type Event_Duration struct {
+	Duration *Duration `protobuf:"bytes,5,opt,name=duration,proto3,oneof"`
+}
+
+type Event_ResourceUsage struct {
+	ResourceUsage *ResourceUsage `protobuf:"bytes,6,opt,name=resource_usage,json=resourceUsage,proto3,oneof"`
+}
+
+type Event_TestResult struct {
+	TestResult *TestResult `protobuf:"bytes,7,opt,name=test_result,json=testResult,proto3,oneof"`
+}
+
+type Event_Error struct {
+	Error *Error `protobuf:"bytes,8,opt,name=error,proto3,oneof"`
+}
+
+type Event_Finish struct {
+	Finish *Finish `protobuf:"bytes,9,opt,name=finish,proto3,oneof"`
+}
+
+type Event_Accepted struct {
+	Accepted *Accepted `protobuf:"bytes,10,opt,name=accepted,proto3,oneof"`
+}
+
+type Event_OutputDropped struct {
+	OutputDropped *OutputDropped `protobuf:"bytes,11,opt,name=output_dropped,json=outputDropped,proto3,oneof"`
+}
+
+func (*Event_StageEvent) isEvent_Event() {}
+
+func (*Event_Output) isEvent_Event() {}
+
+func (*Event_ExitCode) isEvent_Event() {}
+
+func (*Event_Duration) isEvent_Event() {}
+
+func (*Event_ResourceUsage) isEvent_Event() {}
+
+func (*Event_TestResult) isEvent_Event() {}
+
+func (*Event_Error) isEvent_Event() {}
+
+func (*Event_Finish) isEvent_Event() {}
+
+func (*Event_Accepted) isEvent_Event() {}
+
+func (*Event_OutputDropped) isEvent_Event() {}
+
+var File_worker_proto protoreflect.FileDescriptor
+
+const file_worker_proto_rawDesc = "" +
+	"\n" +
+	"\fworker.proto\x12\x14practicode.worker.v1\"\x18\n" +
+	"\x16GetCapabilitiesRequest\"8\n" +
+	"\bBuildEnv\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12\x18\n" +
+	"\atargets\x18\x02 \x03(\tR\atargets\"\xdd\x01\n" +
+	"\fCapabilities\x12=\n" +
+	"\n" +
+	"build_envs\x18\x01 \x03(\v2\x1e.practicode.worker.v1.BuildEnvR\tbuildEnvs\x12\x1f\n" +
+	"\vcheck_types\x18\x02 \x03(\tR\n" +
+	"checkTypes\x123\n" +
+	"\x16max_sources_size_bytes\x18\x03 \x01(\x04R\x13maxSourcesSizeBytes\x128\n" +
+	"\x19max_source_file_name_size\x18\x04 \x01(\x05R\x15maxSourceFileNameSize\"4\n" +
+	"\n" +
+	"SourceFile\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12\x12\n" +
+	"\x04text\x18\x02 \x01(\fR\x04text\"1\n" +
+	"\tTestCheck\x12\x12\n" +
+	"\x04type\x18\x01 \x01(\tR\x04type\x12\x10\n" +
+	"\x03arg\x18\x02 \x01(\tR\x03arg\"e\n" +
+	"\bTestCase\x12 \n" +
+	"\vdescription\x18\x01 \x01(\tR\vdescription\x127\n" +
+	"\x06checks\x18\x02 \x03(\v2\x1f.practicode.worker.v1.TestCheckR\x06checks\"\xbf\x01\n" +
+	"\tTestSuite\x12F\n" +
+	"\x0finit_test_cases\x18\x01 \x03(\v2\x1e.practicode.worker.v1.TestCaseR\rinitTestCases\x12=\n" +
+	"\n" +
+	"test_cases\x18\x02 \x03(\v2\x1e.practicode.worker.v1.TestCaseR\ttestCases\x12+\n" +
+	"\x12run_all_test_cases\x18\x03 \x01(\bR\x0frunAllTestCases\"\xc3\x02\n" +
+	"\x0eExecuteRequest\x12\x1d\n" +
+	"\n" +
+	"request_id\x18\x01 \x01(\tR\trequestId\x12\x1b\n" +
+	"\tbuild_env\x18\x02 \x01(\tR\bbuildEnv\x12\x16\n" +
+	"\x06target\x18\x03 \x01(\tR\x06target\x12C\n" +
+	"\fsource_files\x18\x04 \x03(\v2 .practicode.worker.v1.SourceFileR\vsourceFiles\x12>\n" +
+	"\n" +
+	"test_suite\x18\x05 \x01(\v2\x1f.practicode.worker.v1.TestSuiteR\ttestSuite\x12\x1c\n" +
+	"\trequester\x18\x06 \x01(\tR\trequester\x12\x1c\n" +
+	"\ttimestamp\x18\a \x01(\x03R\ttimestamp\x12\x1c\n" +
+	"\tsignature\x18\b \x01(\tR\tsignature\",\n" +
+	"\vStopRequest\x12\x1d\n" +
+	"\n" +
+	"request_id\x18\x01 \x01(\tR\trequestId\"\x0e\n" +
+	"\fStopResponse\"\xe2\x01\n" +
+	"\x06Limits\x12(\n" +
+	"\x10address_space_mb\x18\x01 \x01(\x04R\x0eaddressSpaceMb\x12 \n" +
+	"\frun_time_sec\x18\x02 \x01(\x02R\n" +
+	"runTimeSec\x12)\n" +
+	"\x10file_descriptors\x18\x03 \x01(\x04R\x0ffileDescriptors\x12$\n" +
+	"\x0efile_writes_mb\x18\x04 \x01(\x04R\ffileWritesMb\x12\x18\n" +
+	"\athreads\x18\x05 \x01(\x04R\athreads\x12!\n" +
+	"\foutput_bytes\x18\x06 \x01(\x04R\voutputBytes\"Y\n" +
+	"\rAcceptedStage\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x124\n" +
+	"\x06limits\x18\x02 \x01(\v2\x1c.practicode.worker.v1.LimitsR\x06limits\"w\n" +
+	"\bAccepted\x12;\n" +
+	"\x06stages\x18\x01 \x03(\v2#.practicode.worker.v1.AcceptedStageR\x06stages\x12.\n" +
+	"\x13test_suite_expected\x18\x02 \x01(\bR\x11testSuiteExpected\"U\n" +
+	"\n" +
+	"StageEvent\x12\x14\n" +
+	"\x05event\x18\x01 \x01(\tR\x05event\x12\x14\n" +
+	"\x05stage\x18\x02 \x01(\tR\x05stage\x12\x1b\n" +
+	"\ttest_case\x18\x03 \x01(\tR\btestCase\"F\n" +
+	"\x06Output\x12\x12\n" +
+	"\x04text\x18\x01 \x01(\fR\x04text\x12\x12\n" +
+	"\x04type\x18\x02 \x01(\tR\x04type\x12\x14\n" +
+	"\x05stage\x18\x03 \x01(\tR\x05stage\"=\n" +
+	"\bExitCode\x12\x1b\n" +
+	"\texit_code\x18\x01 \x01(\x05R\bexitCode\x12\x14\n" +
+	"\x05stage\x18\x02 \x01(\tR\x05stage\"C\n" +
+	"\bDuration\x12!\n" +
+	"\fduration_sec\x18\x01 \x01(\x01R\vdurationSec\x12\x14\n" +
+	"\x05stage\x18\x02 \x01(\tR\x05stage\"e\n" +
+	"\rResourceUsage\x12\x1c\n" +
+	"\n" +
+	"max_rss_kb\x18\x01 \x01(\x03R\bmaxRssKb\x12 \n" +
+	"\fcpu_time_sec\x18\x02 \x01(\x01R\n" +
+	"cpuTimeSec\x12\x14\n" +
+	"\x05stage\x18\x03 \x01(\tR\x05stage\"W\n" +
+	"\n" +
+	"TestResult\x12\x1b\n" +
+	"\ttest_case\x18\x01 \x01(\tR\btestCase\x12\x16\n" +
+	"\x06result\x18\x02 \x01(\bR\x06result\x12\x14\n" +
+	"\x05stage\x18\x03 \x01(\tR\x05stage\"J\n" +
+	"\rOutputDropped\x12#\n" +
+	"\rdropped_bytes\x18\x01 \x01(\x04R\fdroppedBytes\x12\x14\n" +
+	"\x05stage\x18\x02 \x01(\tR\x05stage\"?\n" +
+	"\x05Error\x12 \n" +
+	"\vdescription\x18\x01 \x01(\tR\vdescription\x12\x14\n" +
+	"\x05stage\x18\x02 \x01(\tR\x05stage\"\b\n" +
+	"\x06Finish\"\xb5\x05\n" +
+	"\x05Event\x12\x1d\n" +
+	"\n" +
+	"request_id\x18\x01 \x01(\tR\trequestId\x12C\n" +
+	"\vstage_event\x18\x02 \x01(\v2 .practicode.worker.v1.StageEventH\x00R\n" +
+	"stageEvent\x126\n" +
+	"\x06output\x18\x03 \x01(\v2\x1c.practicode.worker.v1.OutputH\x00R\x06output\x12=\n" +
+	"\texit_code\x18\x04 \x01(\v2\x1e.practicode.worker.v1.ExitCodeH\x00R\bexitCode\x12<\n" +
+	"\bduration\x18\x05 \x01(\v2\x1e.practicode.worker.v1.DurationH\x00R\bduration\x12L\n" +
+	"\x0eresource_usage\x18\x06 \x01(\v2#.practicode.worker.v1.ResourceUsageH\x00R\rresourceUsage\x12C\n" +
+	"\vtest_result\x18\a \x01(\v2 .practicode.worker.v1.TestResultH\x00R\n" +
+	"testResult\x123\n" +
+	"\x05error\x18\b \x01(\v2\x1b.practicode.worker.v1.ErrorH\x00R\x05error\x126\n" +
+	"\x06finish\x18\t \x01(\v2\x1c.practicode.worker.v1.FinishH\x00R\x06finish\x12<\n" +
+	"\baccepted\x18\n" +
+	" \x01(\v2\x1e.practicode.worker.v1.AcceptedH\x00R\baccepted\x12L\n" +
+	"\x0eoutput_dropped\x18\v \x01(\v2#.practicode.worker.v1.OutputDroppedH\x00R\routputDroppedB\a\n" +
+	"\x05event2\x8c\x02\n" +
+	"\x06Worker\x12c\n" +
+	"\x0fGetCapabilities\x12,.practicode.worker.v1.GetCapabilitiesRequest\x1a\".practicode.worker.v1.Capabilities\x12N\n" +
+	"\aExecute\x12$.practicode.worker.v1.ExecuteRequest\x1a\x1b.practicode.worker.v1.Event0\x01\x12M\n" +
+	"\x04Stop\x12!.practicode.worker.v1.StopRequest\x1a\".practicode.worker.v1.StopResponseB3Z1github.com/practicode-org/worker/src/api/workerpbb\x06proto3"
+
+var (
+	file_worker_proto_rawDescOnce sync.Once
+	file_worker_proto_rawDescData []byte
+)
+
+func file_worker_proto_rawDescGZIP() []byte {
+	file_worker_proto_rawDescOnce.Do(func() {
+		file_worker_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_worker_proto_rawDesc), len(file_worker_proto_rawDesc)))
+	})
+	return file_worker_proto_rawDescData
+}
+
+var file_worker_proto_msgTypes = make([]protoimpl.MessageInfo, 23)
+var file_worker_proto_goTypes = []any{
+	(*GetCapabilitiesRequest)(nil), // 0: practicode.worker.v1.GetCapabilitiesRequest
+	(*BuildEnv)(nil),               // 1: practicode.worker.v1.BuildEnv
+	(*Capabilities)(nil),           // 2: practicode.worker.v1.Capabilities
+	(*SourceFile)(nil),             // 3: practicode.worker.v1.SourceFile
+	(*TestCheck)(nil),              // 4: practicode.worker.v1.TestCheck
+	(*TestCase)(nil),               // 5: practicode.worker.v1.TestCase
+	(*TestSuite)(nil),              // 6: practicode.worker.v1.TestSuite
+	(*ExecuteRequest)(nil),         // 7: practicode.worker.v1.ExecuteRequest
+	(*StopRequest)(nil),            // 8: practicode.worker.v1.StopRequest
+	(*StopResponse)(nil),           // 9: practicode.worker.v1.StopResponse
+	(*Limits)(nil),                 // 10: practicode.worker.v1.Limits
+	(*AcceptedStage)(nil),          // 11: practicode.worker.v1.AcceptedStage
+	(*Accepted)(nil),               // 12: practicode.worker.v1.Accepted
+	(*StageEvent)(nil),             // 13: practicode.worker.v1.StageEvent
+	(*Output)(nil),                 // 14: practicode.worker.v1.Output
+	(*ExitCode)(nil),               // 15: practicode.worker.v1.ExitCode
+	(*Duration)(nil),               // 16: practicode.worker.v1.Duration
+	(*ResourceUsage)(nil),          // 17: practicode.worker.v1.ResourceUsage
+	(*TestResult)(nil),             // 18: practicode.worker.v1.TestResult
+	(*OutputDropped)(nil),          // 19: practicode.worker.v1.OutputDropped
+	(*Error)(nil),                  // 20: practicode.worker.v1.Error
+	(*Finish)(nil),                 // 21: practicode.worker.v1.Finish
+	(*Event)(nil),                  // 22: practicode.worker.v1.Event
+}
+var file_worker_proto_depIdxs = []int32{
+	1,  // 0: practicode.worker.v1.Capabilities.build_envs:type_name -> practicode.worker.v1.BuildEnv
+	4,  // 1: practicode.worker.v1.TestCase.checks:type_name -> practicode.worker.v1.TestCheck
+	5,  // 2: practicode.worker.v1.TestSuite.init_test_cases:type_name -> practicode.worker.v1.TestCase
+	5,  // 3: practicode.worker.v1.TestSuite.test_cases:type_name -> practicode.worker.v1.TestCase
+	3,  // 4: practicode.worker.v1.ExecuteRequest.source_files:type_name -> practicode.worker.v1.SourceFile
+	6,  // 5: practicode.worker.v1.ExecuteRequest.test_suite:type_name -> practicode.worker.v1.TestSuite
+	10, // 6: practicode.worker.v1.AcceptedStage.limits:type_name -> practicode.worker.v1.Limits
+	11, // 7: practicode.worker.v1.Accepted.stages:type_name -> practicode.worker.v1.AcceptedStage
+	13, // 8: practicode.worker.v1.Event.stage_event:type_name -> practicode.worker.v1.StageEvent
+	14, // 9: practicode.worker.v1.Event.output:type_name -> practicode.worker.v1.Output
+	15, // 10: practicode.worker.v1.Event.exit_code:type_name -> practicode.worker.v1.ExitCode
+	16, // 11: practicode.worker.v1.Event.duration:type_name -> practicode.worker.v1.Duration
+	17, // 12: practicode.worker.v1.Event.resource_usage:type_name -> practicode.worker.v1.ResourceUsage
+	18, // 13: practicode.worker.v1.Event.test_result:type_name -> practicode.worker.v1.TestResult
+	20, // 14: practicode.worker.v1.Event.error:type_name -> practicode.worker.v1.Error
+	21, // 15: practicode.worker.v1.Event.finish:type_name -> practicode.worker.v1.Finish
+	12, // 16: practicode.worker.v1.Event.accepted:type_name -> practicode.worker.v1.Accepted
+	19, // 17: practicode.worker.v1.Event.output_dropped:type_name -> practicode.worker.v1.OutputDropped
+	0,  // 18: practicode.worker.v1.Worker.GetCapabilities:input_type -> practicode.worker.v1.GetCapabilitiesRequest
+	7,  // 19: practicode.worker.v1.Worker.Execute:input_type -> practicode.worker.v1.ExecuteRequest
+	8,  // 20: practicode.worker.v1.Worker.Stop:input_type -> practicode.worker.v1.StopRequest
+	2,  // 21: practicode.worker.v1.Worker.GetCapabilities:output_type -> practicode.worker.v1.Capabilities
+	22, // 22: practicode.worker.v1.Worker.Execute:output_type -> practicode.worker.v1.Event
+	9,  // 23: practicode.worker.v1.Worker.Stop:output_type -> practicode.worker.v1.StopResponse
+	21, // [21:24] is the sub-list for method output_type
+	18, // [18:21] is the sub-list for method input_type
+	18, // [18:18] is the sub-list for extension type_name
+	18, // [18:18] is the sub-list for extension extendee
+	0,  // [0:18] is the sub-list for field type_name
+}
+
+func init() { file_worker_proto_init() }
+func file_worker_proto_init() {
+	if File_worker_proto != nil {
+		return
+	}
+	file_worker_proto_msgTypes[22].OneofWrappers = []any{
+		(*Event_StageEvent)(nil),
+		(*Event_Output)(nil),
+		(*Event_ExitCode)(nil),
+		(*Event_Duration)(nil),
+		(*Event_ResourceUsage)(nil),
+		(*Event_TestResult)(nil),
+		(*Event_Error)(nil),
+		(*Event_Finish)(nil),
+		(*Event_Accepted)(nil),
+		(*Event_OutputDropped)(nil),
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_worker_proto_rawDesc), len(file_worker_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   23,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_worker_proto_goTypes,
+		DependencyIndexes: file_worker_proto_depIdxs,
+		MessageInfos:      file_worker_proto_msgTypes,
+	}.Build()
+	File_worker_proto = out.File
+	file_worker_proto_goTypes = nil
+	file_worker_proto_depIdxs = nil
+}
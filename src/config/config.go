@@ -1,25 +1,136 @@
 package config
 
 import (
+	"flag"
 	"fmt"
+	"io/ioutil"
+	"math"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
 	SourcesDir            string `json:"sources_dir"`
 	SourcesSizeLimitBytes uint64 `json:"sources_size_limit_bytes"` // Bytes
+	NsjailPath            string `json:"nsjail_path"`
 }
 
 var (
-	Cfg Config
+	// defaults are set here, so commands which don't register the flags get them too
+	Cfg = Config{
+		SourcesDir:            "/tmp/sources",
+		SourcesSizeLimitBytes: 8000,
+		NsjailPath:            "/usr/bin/nsjail",
+	}
 )
 
-func DefaultConfig() error {
-	Cfg.SourcesDir = "/tmp/sources"
-	Cfg.SourcesSizeLimitBytes = 8000
+// AddFlags registers flags of Cfg settings on fs, Validate should be called after parsing them
+func AddFlags(fs *flag.FlagSet) {
+	fs.StringVar(&Cfg.SourcesDir, "sources-dir", Cfg.SourcesDir, "directory to write submitted sources to, must be writable by everyone")
+	fs.Uint64Var(&Cfg.SourcesSizeLimitBytes, "sources-size-limit-bytes", Cfg.SourcesSizeLimitBytes, "max size of all source files of a request together")
+	fs.StringVar(&Cfg.NsjailPath, "nsjail-path", Cfg.NsjailPath, "nsjail executable which runs the stages")
+}
+
+// Limits tells Validate which values of settings are allowed, settings the flag set doesn't have are skipped
+type Limits struct {
+	Positive    []string          // numeric settings which must be greater than zero
+	NonNegative []string          // numeric settings which can't be negative
+	NotLess     map[string]string // numeric settings which can't be less than another one
+	NonEmpty    []string          // settings which must be set
+	Requires    map[string]string // settings which can be set only along with another one
+}
+
+// Validate checks Cfg settings and the values of other settings registered on fs,
+// call it after Load so values from the file and the environment are checked too
+func Validate(fs *flag.FlagSet, limits Limits) error {
+	err := validateCfg()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range limits.Positive {
+		if value, ok := flagNumber(fs, name); ok && value <= 0 {
+			return fmt.Errorf("%s must be positive", name)
+		}
+	}
+	for _, name := range limits.NonNegative {
+		if value, ok := flagNumber(fs, name); ok && value < 0 {
+			return fmt.Errorf("%s can't be negative", name)
+		}
+	}
+	for name, other := range limits.NotLess {
+		value, ok1 := flagNumber(fs, name)
+		otherValue, ok2 := flagNumber(fs, other)
+		if ok1 && ok2 && value < otherValue {
+			return fmt.Errorf("%s can't be less than %s", name, other)
+		}
+	}
+	for _, name := range limits.NonEmpty {
+		if f := fs.Lookup(name); f != nil && f.Value.String() == "" {
+			return fmt.Errorf("%s is empty", name)
+		}
+	}
+	for name, required := range limits.Requires {
+		f, requiredFlag := fs.Lookup(name), fs.Lookup(required)
+		if f != nil && requiredFlag != nil && f.Value.String() != "" && requiredFlag.Value.String() == "" {
+			return fmt.Errorf("%s requires %s", name, required)
+		}
+	}
+	return nil
+}
 
+// IsNumeric tells whether a flag has a numeric value
+func IsNumeric(f *flag.Flag) bool {
+	_, ok := numberOf(f)
+	return ok
+}
+
+// flagNumber returns the value of a numeric flag, durations are in nanoseconds,
+// false if fs has no such flag or it isn't numeric
+func flagNumber(fs *flag.FlagSet, name string) (int64, bool) {
+	f := fs.Lookup(name)
+	if f == nil {
+		return 0, false
+	}
+	return numberOf(f)
+}
+
+// numberOf returns the value of a numeric flag, false if it isn't numeric
+func numberOf(f *flag.Flag) (int64, bool) {
+	getter, ok := f.Value.(flag.Getter)
+	if !ok {
+		return 0, false
+	}
+	switch v := getter.Get().(type) {
+	case int:
+		return int64(v), true
+	case int64:
+		return v, true
+	case time.Duration:
+		return int64(v), true
+	case uint:
+		return clampUint(uint64(v)), true
+	case uint64:
+		return clampUint(v), true
+	}
+	return 0, false
+}
+
+// clampUint converts v to int64, values which don't fit become the max int64
+func clampUint(v uint64) int64 {
+	if v > math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return int64(v)
+}
+
+// validateCfg checks Cfg settings
+func validateCfg() error {
 	// check sources directory
 	stat, err := os.Stat(Cfg.SourcesDir)
 	if err != nil {
@@ -40,5 +151,136 @@ func DefaultConfig() error {
 	} else if Cfg.SourcesSizeLimitBytes > 1024*1024*10 {
 		log.Warningf("SourcesSizeLimitBytes %d seems too high\n", Cfg.SourcesSizeLimitBytes)
 	}
+
+	// check nsjail
+	if !filepath.IsAbs(Cfg.NsjailPath) {
+		return fmt.Errorf("NsjailPath must be absolute: %s", Cfg.NsjailPath)
+	}
+	stat, err = os.Stat(Cfg.NsjailPath)
+	if err != nil {
+		return fmt.Errorf("failed to get stats of NsjailPath: %s", Cfg.NsjailPath)
+	}
+	if !stat.Mode().IsRegular() || stat.Mode()&0111 == 0 {
+		return fmt.Errorf("NsjailPath isn't an executable file: %s", Cfg.NsjailPath)
+	}
 	return nil
 }
+
+// Origins of flag values
+const (
+	OriginDefault = "default"
+	OriginFile    = "file"
+	OriginEnv     = "env"
+	OriginFlag    = "flag"
+)
+
+// EnvName returns the environment variable of a flag, ex: WORKER_LISTEN_ADDR for listen-addr with prefix WORKER_
+func EnvName(prefix string, flagName string) string {
+	return prefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// Load sets flags of fs which weren't given on the command line from the config file at path (skipped if empty)
+// and environment variables, the command line overrides environment and environment overrides the file.
+// The file is YAML with flag names as keys, ex: "listen-addr: 0.0.0.0:1556". Values are parsed the same way flags are.
+// Returns where the value of every flag came from.
+func Load(fs *flag.FlagSet, path string, envPrefix string) (map[string]string, error) {
+	return load(fs, path, envPrefix, false)
+}
+
+// LoadShared is Load for commands which have only some of the settings of the file, the rest of the file is skipped
+func LoadShared(fs *flag.FlagSet, path string, envPrefix string) (map[string]string, error) {
+	return load(fs, path, envPrefix, true)
+}
+
+func load(fs *flag.FlagSet, path string, envPrefix string, skipUnknown bool) (map[string]string, error) {
+	origins := map[string]string{}
+	fs.VisitAll(func(f *flag.Flag) {
+		origins[f.Name] = OriginDefault
+	})
+	fs.Visit(func(f *flag.Flag) {
+		origins[f.Name] = OriginFlag
+	})
+
+	if path != "" {
+		values, err := readFile(path)
+		if err != nil {
+			return nil, err
+		}
+		for name, value := range values {
+			if fs.Lookup(name) == nil {
+				if skipUnknown {
+					continue
+				}
+				return nil, fmt.Errorf("unknown setting %s in %s", name, path)
+			}
+			if origins[name] == OriginFlag {
+				continue
+			}
+			err = fs.Set(name, value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s in %s: %w", name, path, err)
+			}
+			origins[name] = OriginFile
+		}
+	}
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || origins[f.Name] == OriginFlag {
+			return
+		}
+		env := EnvName(envPrefix, f.Name)
+		value, ok := os.LookupEnv(env)
+		if !ok {
+			return
+		}
+		setErr := fs.Set(f.Name, value)
+		if setErr != nil {
+			err = fmt.Errorf("invalid %s: %w", env, setErr)
+			return
+		}
+		origins[f.Name] = OriginEnv
+	})
+	if err != nil {
+		return nil, err
+	}
+	return origins, nil
+}
+
+// readFile reads a YAML config file, values must be scalars
+func readFile(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	nodes := map[string]yaml.Node{}
+	err = yaml.Unmarshal(data, &nodes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	values := map[string]string{}
+	for name, node := range nodes {
+		if node.Kind != yaml.ScalarNode {
+			return nil, fmt.Errorf("%s in %s must be a single value, line %d", name, path, node.Line)
+		}
+		values[name] = node.Value
+	}
+	return values, nil
+}
+
+// isSecret tells whether the flag's value shouldn't be printed
+func isSecret(name string) bool {
+	return strings.Contains(name, "token") || strings.Contains(name, "secret")
+}
+
+// Print logs effective values of all flags of fs with their origins, secrets are masked
+func Print(fs *flag.FlagSet, origins map[string]string) {
+	log.Infof("Effective settings:")
+	fs.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if isSecret(f.Name) && value != "" {
+			value = "<hidden>"
+		}
+		log.Infof("  %s = %q (%s)", f.Name, value, origins[f.Name])
+	})
+}
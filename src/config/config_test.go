@@ -0,0 +1,167 @@
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useValidCfg points Cfg to a writable sources directory and an executable nsjail stand-in
+func useValidCfg(t *testing.T) {
+	t.Helper()
+	saved := Cfg
+	t.Cleanup(func() { Cfg = saved })
+
+	dir := t.TempDir()
+	nsjailPath := filepath.Join(dir, "nsjail")
+	if err := ioutil.WriteFile(nsjailPath, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	Cfg.SourcesDir = dir
+	Cfg.NsjailPath = nsjailPath
+}
+
+// workerFlags registers some of the worker's settings with their defaults
+func workerFlags() *flag.FlagSet {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("rules-dir", "rules", "")
+	fs.Int64("max-message-size", 1024, "")
+	fs.Duration("write-timeout", time.Second, "")
+	fs.Duration("pong-timeout", time.Second, "")
+	fs.Int("max-queued-jobs", 100, "")
+	fs.Int("max-jobs", 1000, "")
+	fs.Duration("reconnect-min-delay", time.Second, "")
+	fs.Duration("reconnect-max-delay", time.Minute, "")
+	fs.Uint64("min-free-disk-mb", 100, "")
+	fs.String("audit-log", "", "")
+	fs.String("audit-sources-dir", "", "")
+	return fs
+}
+
+// workerLimits are limits of the settings of workerFlags
+var workerLimits = Limits{
+	Positive:    []string{"max-message-size", "write-timeout", "max-queued-jobs", "max-jobs", "reconnect-min-delay"},
+	NonNegative: []string{"pong-timeout", "min-free-disk-mb"},
+	NotLess:     map[string]string{"max-jobs": "max-queued-jobs", "reconnect-max-delay": "reconnect-min-delay"},
+	NonEmpty:    []string{"rules-dir"},
+	Requires:    map[string]string{"audit-sources-dir": "audit-log"},
+}
+
+func TestDefaults(t *testing.T) {
+	// commands which don't register the flags still get usable values
+	if Cfg.NsjailPath != "/usr/bin/nsjail" || Cfg.SourcesDir == "" || Cfg.SourcesSizeLimitBytes == 0 {
+		t.Errorf("no defaults: %+v", Cfg)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		set  map[string]string
+		err  string
+	}{
+		{"defaults", nil, ""},
+		{"zero", map[string]string{"max-message-size": "0"}, "max-message-size must be positive"},
+		{"negative duration", map[string]string{"pong-timeout": "-1s"}, "pong-timeout can't be negative"},
+		{"zero duration allowed", map[string]string{"pong-timeout": "0s"}, ""},
+		{"empty rules-dir", map[string]string{"rules-dir": ""}, "rules-dir is empty"},
+		{"max-jobs under max-queued-jobs", map[string]string{"max-jobs": "10"}, "max-jobs can't be less than max-queued-jobs"},
+		{"required setting", map[string]string{"audit-sources-dir": "/tmp/a"}, "audit-sources-dir requires audit-log"},
+		{"durations", map[string]string{"reconnect-max-delay": "500ms"}, "reconnect-max-delay can't be less than reconnect-min-delay"},
+		{"zero min duration", map[string]string{"reconnect-min-delay": "0s", "reconnect-max-delay": "0s"}, "reconnect-min-delay must be positive"},
+		{"unsigned", map[string]string{"min-free-disk-mb": "0"}, ""},
+		{"required setting set", map[string]string{"audit-sources-dir": "/tmp/a", "audit-log": "/tmp/log"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useValidCfg(t)
+			fs := workerFlags()
+			for name, value := range tt.set {
+				if err := fs.Set(name, value); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := Validate(fs, workerLimits)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestValidateLoadedValues(t *testing.T) {
+	useValidCfg(t)
+	fs := workerFlags()
+	path := filepath.Join(t.TempDir(), "worker.yml")
+	if err := ioutil.WriteFile(path, []byte("max-message-size: -5\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_WRITE_TIMEOUT", "2s")
+
+	if _, err := Load(fs, path, "TEST_"); err != nil {
+		t.Fatal(err)
+	}
+	err := Validate(fs, workerLimits)
+	if err == nil || !strings.Contains(err.Error(), "max-message-size must be positive") {
+		t.Fatalf("value from the file isn't checked: %v", err)
+	}
+
+	t.Setenv("TEST_PONG_TIMEOUT", "-1s")
+	fs = workerFlags()
+	if _, err := Load(fs, "", "TEST_"); err != nil {
+		t.Fatal(err)
+	}
+	err = Validate(fs, workerLimits)
+	if err == nil || !strings.Contains(err.Error(), "pong-timeout can't be negative") {
+		t.Fatalf("value from the environment isn't checked: %v", err)
+	}
+}
+
+func TestValidateWithoutWorkerFlags(t *testing.T) {
+	// run and grade have only some of the settings, the rest aren't checked
+	useValidCfg(t)
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	AddFlags(fs)
+	if err := Validate(fs, workerLimits); err != nil {
+		t.Fatal(err)
+	}
+	fs.Set("sources-size-limit-bytes", "0")
+	if err := Validate(fs, workerLimits); err == nil {
+		t.Fatal("zero sources-size-limit-bytes: expected an error")
+	}
+}
+
+func TestLoadShared(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "worker.yml")
+	if err := ioutil.WriteFile(path, []byte("rules-dir: /run/rules\nlisten-addr: 0.0.0.0:1556\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	fs.String("rules-dir", "", "")
+	if _, err := Load(fs, path, "TEST_"); err == nil {
+		t.Fatal("Load: expected an error about the unknown listen-addr")
+	}
+
+	fs = flag.NewFlagSet("run", flag.ContinueOnError)
+	rulesDir := fs.String("rules-dir", "", "")
+	origins, err := LoadShared(fs, path, "TEST_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *rulesDir != "/run/rules" || origins["rules-dir"] != OriginFile {
+		t.Errorf("rules-dir = %q (%s), want /run/rules from the file", *rulesDir, origins["rules-dir"])
+	}
+}
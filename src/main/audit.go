@@ -0,0 +1,235 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/practicode-org/worker/src/api"
+	"github.com/practicode-org/worker/src/rules"
+)
+
+// audit log of executed requests, nil if it's disabled
+var audit *auditLog
+
+// auditLog appends one JSON line per request to a file, which is rotated once it grows over maxSize:
+// path.1 is the newest rotated file, files over maxFiles are removed
+type auditLog struct {
+	mu         sync.Mutex
+	path       string
+	file       *os.File
+	size       int64
+	maxSize    int64
+	maxFiles   int
+	sourcesDir string // submitted sources are kept there if it's set
+}
+
+func openAuditLog(path string, maxSize int64, maxFiles int, sourcesDir string) (*auditLog, error) {
+	l := &auditLog{path: path, maxSize: maxSize, maxFiles: maxFiles, sourcesDir: sourcesDir}
+	if sourcesDir != "" {
+		err := os.MkdirAll(sourcesDir, 0750)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create audit sources directory: %w", err)
+		}
+	}
+	err := l.open()
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *auditLog) open() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat audit log: %w", err)
+	}
+	l.file = file
+	l.size = stat.Size()
+	return nil
+}
+
+// rotate renames path.N-1 to path.N, ..., path to path.1 and starts a new file
+func (l *auditLog) rotate() error {
+	l.file.Close()
+	os.Remove(fmt.Sprintf("%s.%d", l.path, l.maxFiles))
+	for i := l.maxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+	}
+	if l.maxFiles > 0 {
+		os.Rename(l.path, l.path+".1")
+	} else {
+		os.Remove(l.path)
+	}
+	return l.open()
+}
+
+func (l *auditLog) write(record *auditRecord) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Errorf("Failed to marshal audit record of request %s: %v", record.RequestID, err)
+		return
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		err = l.rotate()
+		if err != nil {
+			log.Errorf("Failed to rotate audit log: %v", err)
+			return
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		log.Errorf("Failed to write audit record of request %s: %v", record.RequestID, err)
+	}
+}
+
+// keepSources copies submitted sources to a directory of the request, returns its path
+func (l *auditLog) keepSources(requestID string, names []string, texts []string) (string, error) {
+	safeID := strings.Map(func(r rune) rune {
+		if ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9') || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, requestID)
+	dir, err := ioutil.TempDir(l.sourcesDir, time.Now().UTC().Format("20060102T150405-")+trimLongString(safeID, 64)+"-")
+	if err != nil {
+		return "", err
+	}
+	for i, name := range names {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(texts[i]), 0640)
+		if err != nil {
+			return dir, err
+		}
+	}
+	return dir, nil
+}
+
+type auditSource struct {
+	Name   string `json:"name"`
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+type auditStage struct {
+	Stage    string     `json:"stage"`
+	TestCase string     `json:"test_case,omitempty"`
+	Command  string     `json:"command"`
+	Limits   api.Limits `json:"limits"`
+	// "exited", "stopped" (the request was stopped), "limit:<name>" (killed for exceeding the limit), "error" (failed to run)
+	ExitReason  string  `json:"exit_reason"`
+	ExitCode    int     `json:"exit_code"`
+	DurationSec float64 `json:"duration_sec"`
+	MaxRSSKb    int64   `json:"max_rss_kb,omitempty"`
+	CPUTimeSec  float64 `json:"cpu_time_sec,omitempty"`
+	OutputBytes uint64  `json:"output_bytes"`
+}
+
+// auditRecord is collected while the request runs and written to the audit log when it finishes
+type auditRecord struct {
+	mu        sync.Mutex
+	startTime time.Time
+
+	Time        time.Time     `json:"time"`
+	RequestID   string        `json:"request_id"`
+	Requester   string        `json:"requester,omitempty"` // as told by the backend or the API client
+	BuildEnv    string        `json:"build_env"`
+	Target      string        `json:"target"`
+	Sources     []auditSource `json:"sources,omitempty"`
+	SourcesDir  string        `json:"sources_dir,omitempty"` // where the sources are kept, if they are
+	Stages      []auditStage  `json:"stages"`
+	Errors      []string      `json:"errors,omitempty"`
+	Outcome     string        `json:"outcome"`
+	QueueSec    float64       `json:"queue_sec"`
+	DurationSec float64       `json:"duration_sec"`
+}
+
+func newAuditRecord(requestID string, requester string, buildEnv string, target string) *auditRecord {
+	return &auditRecord{
+		startTime: time.Now(),
+		RequestID: requestID,
+		Requester: requester,
+		BuildEnv:  buildEnv,
+		Target:    target,
+		Stages:    []auditStage{},
+	}
+}
+
+// setSources records hashes of the sources and keeps them if the audit log is configured to
+func (r *auditRecord) setSources(filePaths []string, texts []string) {
+	names := []string{}
+	for i, filePath := range filePaths {
+		name := filepath.Base(filePath)
+		names = append(names, name)
+		r.Sources = append(r.Sources, auditSource{Name: name, Size: len(texts[i]), SHA256: fmt.Sprintf("%x", sha256.Sum256([]byte(texts[i])))})
+	}
+	if audit == nil || audit.sourcesDir == "" {
+		return
+	}
+	dir, err := audit.keepSources(r.RequestID, names, texts)
+	if err != nil {
+		log.Errorf("Failed to keep sources of request %s: %v", r.RequestID, err)
+		r.addError(fmt.Sprintf("failed to keep sources: %v", err))
+	}
+	r.SourcesDir = dir
+}
+
+// newAuditStage returns a record of a stage run to fill and pass to addStage, testCaseIdx is -1 if there's no test case
+func newAuditStage(stage *rules.Stage, testCaseIdx int, command string) auditStage {
+	s := auditStage{Stage: stage.Name, Command: command, Limits: apiLimits(stage.Limits)}
+	if testCaseIdx >= 0 {
+		s.TestCase = strconv.Itoa(testCaseIdx)
+	}
+	return s
+}
+
+// addStage records a finished stage run, stages of a layer run in parallel
+func (r *auditRecord) addStage(s auditStage) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Stages = append(r.Stages, s)
+}
+
+func (r *auditRecord) addError(desc string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Errors = append(r.Errors, desc)
+}
+
+// auditRejected writes the record of a request which was rejected before it could start
+func auditRejected(requestID string, requester string, buildEnv string, target string, reason string) {
+	record := newAuditRecord(requestID, requester, buildEnv, target)
+	record.addError(reason)
+	record.finish(outcomeRejected)
+}
+
+// finish writes the record to the audit log, if it's enabled
+func (r *auditRecord) finish(outcome string) {
+	if audit == nil {
+		return
+	}
+	r.mu.Lock()
+	r.Time = time.Now().UTC()
+	r.Outcome = outcome
+	r.DurationSec = time.Since(r.startTime).Seconds()
+	r.mu.Unlock()
+	audit.write(r)
+}
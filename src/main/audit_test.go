@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/practicode-org/worker/src/api"
+	"github.com/practicode-org/worker/src/config"
+)
+
+// useAuditLog enables the audit log in a temporary file, the returned function reads its records
+func useAuditLog(t *testing.T) func() []*auditRecord {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	l, err := openAuditLog(path, 1024*1024, 1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := audit
+	audit = l
+	t.Cleanup(func() { audit = saved })
+
+	return func() []*auditRecord {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		records := []*auditRecord{}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			record := &auditRecord{}
+			if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+				t.Fatalf("bad audit record %s: %v", scanner.Text(), err)
+			}
+			records = append(records, record)
+		}
+		return records
+	}
+}
+
+// dialRun connects to /run of a test server and does the handshake
+func dialRun(t *testing.T) *websocket.Conn {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handleRun(w, r, nil)
+	}))
+	t.Cleanup(server.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/run", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, _, err := conn.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteJSON(api.Envelope{Type: api.TypeHello, Version: api.ProtocolVersion, Seq: 1}); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// readUntil reads messages until one of the given type
+func readUntil(t *testing.T, conn *websocket.Conn, type_ string) api.Envelope {
+	t.Helper()
+	for {
+		env := api.Envelope{}
+		if err := conn.ReadJSON(&env); err != nil {
+			t.Fatalf("waiting for %s: %v", type_, err)
+		}
+		if env.Type == type_ {
+			return env
+		}
+	}
+}
+
+func TestAuditRejectedRequests(t *testing.T) {
+	useTestWorker(t)
+	readRecords := useAuditLog(t)
+	savedSecret := *requestSecretFlag
+	defer func() { *requestSecretFlag = savedSecret }()
+
+	tests := []struct {
+		name    string
+		secret  string
+		version int
+		msg     api.ClientMessage
+		reason  string
+	}{
+		{"unknown build env", "", api.ProtocolVersion, api.ClientMessage{RequestID: "r1", BuildEnv: "nope", Target: "compile"}, "Failed to pick build env"},
+		{"unknown target", "", api.ProtocolVersion, api.ClientMessage{RequestID: "r2", BuildEnv: "sh", Target: "nope"}, "Failed to figure out rules for target nope"},
+		{"bad signature", "s", api.ProtocolVersion, api.ClientMessage{RequestID: "r3", BuildEnv: "sh", Target: "compile", Requester: "student"}, "Rejected request: the request isn't signed"},
+		{"protocol version", "", api.ProtocolVersion + 1, api.ClientMessage{RequestID: "r4", BuildEnv: "sh", Target: "compile"}, "Rejected new message of protocol version"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*requestSecretFlag = tt.secret
+			conn := dialRun(t)
+			env, err := api.NewEnvelope(api.TypeNew, 2, tt.msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			env.Version = tt.version
+			if err := conn.WriteJSON(env); err != nil {
+				t.Fatal(err)
+			}
+			readUntil(t, conn, api.TypeError)
+
+			records := readRecords()
+			record := records[len(records)-1]
+			if record.RequestID != tt.msg.RequestID || record.Requester != tt.msg.Requester || record.Outcome != outcomeRejected {
+				t.Errorf("got record %+v", record)
+			}
+			if len(record.Errors) != 1 || !strings.Contains(record.Errors[0], tt.reason) {
+				t.Errorf("record errors %v don't mention %q", record.Errors, tt.reason)
+			}
+		})
+	}
+}
+
+func TestAuditBusyRejection(t *testing.T) {
+	useTestWorker(t)
+	readRecords := useAuditLog(t)
+
+	conn := dialRun(t)
+	for i, id := range []string{"first", "second"} {
+		env, err := api.NewEnvelope(api.TypeNew, uint64(i+2), api.ClientMessage{RequestID: id, BuildEnv: "sh", Target: "compile"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.WriteJSON(env); err != nil {
+			t.Fatal(err)
+		}
+	}
+	readUntil(t, conn, api.TypeError)
+
+	records := readRecords()
+	if len(records) != 1 {
+		t.Fatalf("got %d records, want 1", len(records))
+	}
+	if records[0].RequestID != "second" || records[0].Outcome != outcomeRejected || len(records[0].Errors) != 1 ||
+		records[0].Errors[0] != "Request first is still running" {
+		t.Errorf("got record %+v", records[0])
+	}
+
+	// stop the first request, so it doesn't outlive the test
+	env, err := api.NewEnvelope(api.TypeStop, 4, api.ClientMessage{RequestID: "first"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteJSON(env); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		finish := api.Finish{}
+		json.Unmarshal(readUntil(t, conn, api.TypeFinish).Payload, &finish)
+		if finish.RequestID == "first" {
+			break
+		}
+	}
+}
+
+func TestAuditRequestErrors(t *testing.T) {
+	// every error sent to the client is in the record too
+	useTestWorker(t)
+	readRecords := useAuditLog(t)
+	config.Cfg.SourcesDir = filepath.Join(t.TempDir(), "missing")
+
+	conn := dialRun(t)
+	env, err := api.NewEnvelope(api.TypeNew, 2, api.ClientMessage{RequestID: "no-sources-dir", BuildEnv: "sh", Target: "compile"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteJSON(env); err != nil {
+		t.Fatal(err)
+	}
+	sent := api.Error{}
+	json.Unmarshal(readUntil(t, conn, api.TypeError).Payload, &sent)
+	readUntil(t, conn, api.TypeFinish)
+
+	records := readRecords()
+	if len(records) != 1 || records[0].Outcome != outcomeError {
+		t.Fatalf("got records %+v, want one failed request", records)
+	}
+	if len(records[0].Errors) != 1 || !strings.EqualFold(records[0].Errors[0], sent.Desc) {
+		t.Errorf("record errors %v, want %q", records[0].Errors, sent.Desc)
+	}
+}
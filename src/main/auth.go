@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/practicode-org/worker/src/api"
+)
+
+// signed requests older than that are rejected, so a captured one can't be replayed later
+const requestSignatureMaxAge = time.Minute * 5
+
+// replayCache remembers ids of signed requests until their signatures expire, so a captured request
+// can't be sent again while it's still valid
+type replayCache struct {
+	mu   sync.Mutex
+	seen map[string]time.Time // request id -> when its signature expires
+}
+
+var seenRequests = &replayCache{seen: make(map[string]time.Time)}
+
+// add returns false if the request id was already seen
+func (c *replayCache) add(requestID string, expires time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for id, exp := range c.seen {
+		if now.After(exp) {
+			delete(c.seen, id)
+		}
+	}
+	if _, ok := c.seen[requestID]; ok {
+		return false
+	}
+	c.seen[requestID] = expires
+	return true
+}
+
+// signHMAC returns hex HMAC-SHA256 of the parts joined with new lines
+func signHMAC(secret string, parts ...string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.Join(parts, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// backendDialHeader returns headers authenticating the worker to the backend:
+// "Authorization: Bearer <token>" if token is set and, if hmacSecret is set,
+// X-Worker-Timestamp (unix seconds) with X-Worker-Signature = HMAC(timestamp + "\n" + requestURI)
+func backendDialHeader(token string, hmacSecret string, requestURI string) http.Header {
+	header := http.Header{}
+	if token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+	if hmacSecret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		header.Set("X-Worker-Timestamp", timestamp)
+		header.Set("X-Worker-Signature", signHMAC(hmacSecret, timestamp, requestURI))
+	}
+	return header
+}
+
+func readCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA certificate: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return pool, nil
+}
+
+// backendTLSConfig returns TLS config for dialing the backend, caFile replaces system CAs if set,
+// certFile and keyFile are the client certificate presented to the backend
+func backendTLSConfig(caFile string, certFile string, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pool, err := readCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// listenTLSConfig returns TLS config for serving, if clientCAFile is set clients must present certificates signed by it
+func listenTLSConfig(certFile string, keyFile string, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate: %w", err)
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{cert}}
+	if clientCAFile != "" {
+		pool, err := readCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+func tokenMatches(got string, token string) bool {
+	return subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// requireToken rejects requests without "Authorization: Bearer <token>", browsers which can't set headers
+// on websockets may pass it as the access_token query parameter. Empty token allows everyone.
+func requireToken(token string, next http.HandlerFunc) http.HandlerFunc {
+	if token == "" {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if got == "" {
+			got = r.URL.Query().Get("access_token")
+		}
+		if !tokenMatches(got, token) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSONError(w, http.StatusUnauthorized, "", "missing or wrong token")
+			return
+		}
+		next(w, r)
+	}
+}
+
+func checkGRPCToken(ctx context.Context, token string) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get("authorization") {
+		if tokenMatches(strings.TrimPrefix(value, "Bearer "), token) {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "missing or wrong token")
+}
+
+// grpcTokenOptions returns interceptors checking the "authorization: Bearer <token>" metadata, none if token is empty
+func grpcTokenOptions(token string) []grpc.ServerOption {
+	if token == "" {
+		return nil
+	}
+	return []grpc.ServerOption{
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if err := checkGRPCToken(ctx, token); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := checkGRPCToken(ss.Context(), token); err != nil {
+				return err
+			}
+			return handler(srv, ss)
+		}),
+	}
+}
+
+// sourcesHash returns hex SHA-256 of "<name>\n<hex SHA-256 of the text>\n" of every source file in order
+func sourcesHash(names []string, texts []string) string {
+	hash := sha256.New()
+	for i, name := range names {
+		fmt.Fprintf(hash, "%s\n%x\n", name, sha256.Sum256([]byte(texts[i])))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// verifyRequestSignature checks that a "new" message is signed with the secret:
+// signature = HMAC(request_id + "\n" + requester + "\n" + build_env + "\n" + target + "\n" + timestamp + "\n" + sources_hash),
+// and that its request id wasn't used by another signed request yet
+func verifyRequestSignature(secret string, msg api.ClientMessage) error {
+	if msg.Signature == "" {
+		return errors.New("the request isn't signed")
+	}
+	if msg.RequestID == "" || msg.SourcesHash == "" {
+		return errors.New("signed requests must have request_id and sources_hash")
+	}
+	signedAt := time.Unix(msg.Timestamp, 0)
+	age := time.Since(signedAt)
+	if age > requestSignatureMaxAge || age < -requestSignatureMaxAge {
+		return fmt.Errorf("the request signature has expired, timestamp %d", msg.Timestamp)
+	}
+	expected := signHMAC(secret, msg.RequestID, msg.Requester, msg.BuildEnv, msg.Target, strconv.FormatInt(msg.Timestamp, 10), strings.ToLower(msg.SourcesHash))
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(msg.Signature))) {
+		return errors.New("wrong request signature")
+	}
+	if !seenRequests.add(msg.RequestID, signedAt.Add(requestSignatureMaxAge)) {
+		return fmt.Errorf("request %s was already received", msg.RequestID)
+	}
+	return nil
+}
+
+// verifyExecuteSignature checks the signature of an HTTP or gRPC request if the worker requires signed requests,
+// the signed sources hash is computed from its source files
+func verifyExecuteSignature(body api.ExecuteRequest) error {
+	if *requestSecretFlag == "" {
+		return nil
+	}
+	names := make([]string, 0, len(body.SourceFiles))
+	texts := make([]string, 0, len(body.SourceFiles))
+	for _, sf := range body.SourceFiles {
+		names = append(names, sf.Name)
+		texts = append(texts, sf.Text)
+	}
+	return verifyRequestSignature(*requestSecretFlag, api.ClientMessage{
+		RequestID:   body.RequestID,
+		Requester:   body.Requester,
+		BuildEnv:    body.BuildEnv,
+		Target:      body.Target,
+		Timestamp:   body.Timestamp,
+		Signature:   body.Signature,
+		SourcesHash: sourcesHash(names, texts),
+	})
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/practicode-org/worker/src/api"
+)
+
+// signedMessage returns a "new" message signed with the secret at the given time
+func signedMessage(secret string, requestID string, signedAt time.Time, hash string) api.ClientMessage {
+	msg := api.ClientMessage{RequestID: requestID, Requester: "alice", BuildEnv: "cpp", Target: "run", Timestamp: signedAt.Unix(), SourcesHash: hash}
+	msg.Signature = signHMAC(secret, msg.RequestID, msg.Requester, msg.BuildEnv, msg.Target, strconv.FormatInt(msg.Timestamp, 10), msg.SourcesHash)
+	return msg
+}
+
+// useReplayCache gives the test an empty replay cache, so it can run more than once
+func useReplayCache(t *testing.T) {
+	saved := seenRequests
+	seenRequests = &replayCache{seen: make(map[string]time.Time)}
+	t.Cleanup(func() { seenRequests = saved })
+}
+
+func TestVerifyRequestSignature(t *testing.T) {
+	useReplayCache(t)
+	hash := sourcesHash([]string{"main.cpp"}, []string{"int main() {}"})
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		secret string
+		msg    func(id string) api.ClientMessage
+		err    string
+	}{
+		{
+			name:   "valid",
+			secret: "s",
+			msg:    func(id string) api.ClientMessage { return signedMessage("s", id, now, hash) },
+		},
+		{
+			name:   "upper case signature",
+			secret: "s",
+			msg: func(id string) api.ClientMessage {
+				msg := signedMessage("s", id, now, hash)
+				msg.Signature = strings.ToUpper(msg.Signature)
+				return msg
+			},
+		},
+		{
+			name:   "slightly in the future",
+			secret: "s",
+			msg:    func(id string) api.ClientMessage { return signedMessage("s", id, now.Add(time.Minute), hash) },
+		},
+		{
+			name:   "not signed",
+			secret: "s",
+			msg: func(id string) api.ClientMessage {
+				return api.ClientMessage{RequestID: id, Target: "run", SourcesHash: hash}
+			},
+			err: "isn't signed",
+		},
+		{
+			name:   "wrong secret",
+			secret: "s",
+			msg:    func(id string) api.ClientMessage { return signedMessage("other", id, now, hash) },
+			err:    "wrong request signature",
+		},
+		{
+			name:   "changed target",
+			secret: "s",
+			msg: func(id string) api.ClientMessage {
+				msg := signedMessage("s", id, now, hash)
+				msg.Target = "run_tests"
+				return msg
+			},
+			err: "wrong request signature",
+		},
+		{
+			name:   "changed requester",
+			secret: "s",
+			msg: func(id string) api.ClientMessage {
+				msg := signedMessage("s", id, now, hash)
+				msg.Requester = "mallory"
+				return msg
+			},
+			err: "wrong request signature",
+		},
+		{
+			name:   "removed requester",
+			secret: "s",
+			msg: func(id string) api.ClientMessage {
+				msg := signedMessage("s", id, now, hash)
+				msg.Requester = ""
+				return msg
+			},
+			err: "wrong request signature",
+		},
+		{
+			name:   "changed sources",
+			secret: "s",
+			msg: func(id string) api.ClientMessage {
+				msg := signedMessage("s", id, now, hash)
+				msg.SourcesHash = sourcesHash([]string{"main.cpp"}, []string{"int main() { evil(); }"})
+				return msg
+			},
+			err: "wrong request signature",
+		},
+		{
+			name:   "no sources hash",
+			secret: "s",
+			msg:    func(id string) api.ClientMessage { return signedMessage("s", id, now, "") },
+			err:    "must have request_id and sources_hash",
+		},
+		{
+			name:   "expired",
+			secret: "s",
+			msg: func(id string) api.ClientMessage {
+				return signedMessage("s", id, now.Add(-requestSignatureMaxAge-time.Second), hash)
+			},
+			err: "has expired",
+		},
+		{
+			name:   "too far in the future",
+			secret: "s",
+			msg: func(id string) api.ClientMessage {
+				return signedMessage("s", id, now.Add(requestSignatureMaxAge+time.Minute), hash)
+			},
+			err: "has expired",
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyRequestSignature(tt.secret, tt.msg("test-request-"+strconv.Itoa(i)))
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestVerifyRequestSignatureReplay(t *testing.T) {
+	useReplayCache(t)
+	hash := sourcesHash([]string{"main.cpp"}, []string{"int main() {}"})
+	msg := signedMessage("s", "replayed-request", time.Now(), hash)
+	if err := verifyRequestSignature("s", msg); err != nil {
+		t.Fatalf("first request: %v", err)
+	}
+	err := verifyRequestSignature("s", msg)
+	if err == nil || !strings.Contains(err.Error(), "already received") {
+		t.Fatalf("replayed request: error = %v", err)
+	}
+
+	// a rejected request doesn't take its id
+	bad := signedMessage("other", "rejected-request", time.Now(), hash)
+	verifyRequestSignature("s", bad)
+	if err := verifyRequestSignature("s", signedMessage("s", "rejected-request", time.Now(), hash)); err != nil {
+		t.Fatalf("request after a rejected one with the same id: %v", err)
+	}
+}
+
+func TestReplayCacheExpiry(t *testing.T) {
+	cache := &replayCache{seen: make(map[string]time.Time)}
+	if !cache.add("a", time.Now().Add(-time.Second)) {
+		t.Fatal("first add of a returned false")
+	}
+	// a has expired, so it's forgotten and can be added again
+	if !cache.add("a", time.Now().Add(time.Minute)) {
+		t.Fatal("add of expired a returned false")
+	}
+	if cache.add("a", time.Now().Add(time.Minute)) {
+		t.Fatal("add of seen a returned true")
+	}
+}
+
+func TestSourcesHash(t *testing.T) {
+	base := sourcesHash([]string{"a.cpp", "b.cpp"}, []string{"1", "2"})
+	tests := []struct {
+		name  string
+		names []string
+		texts []string
+	}{
+		{"other text", []string{"a.cpp", "b.cpp"}, []string{"1", "3"}},
+		{"other name", []string{"a.cpp", "c.cpp"}, []string{"1", "2"}},
+		{"other order", []string{"b.cpp", "a.cpp"}, []string{"2", "1"}},
+		{"text moved between files", []string{"a.cpp", "b.cpp"}, []string{"12", ""}},
+		{"fewer files", []string{"a.cpp"}, []string{"1"}},
+	}
+	for _, tt := range tests {
+		if sourcesHash(tt.names, tt.texts) == base {
+			t.Errorf("%s: got the same hash", tt.name)
+		}
+	}
+}
+
+func TestVerifyExecuteSignature(t *testing.T) {
+	useReplayCache(t)
+	saved := *requestSecretFlag
+	defer func() { *requestSecretFlag = saved }()
+
+	body := api.ExecuteRequest{
+		RequestID:   "execute-request",
+		Requester:   "alice",
+		Target:      "run",
+		SourceFiles: []api.SourceFile{{Name: "main.cpp", Text: "int main() {}"}},
+		Timestamp:   time.Now().Unix(),
+	}
+	hash := sourcesHash([]string{"main.cpp"}, []string{"int main() {}"})
+	body.Signature = signHMAC("s", body.RequestID, body.Requester, "", body.Target, strconv.FormatInt(body.Timestamp, 10), hash)
+
+	*requestSecretFlag = ""
+	if err := verifyExecuteSignature(api.ExecuteRequest{Target: "run"}); err != nil {
+		t.Fatalf("no secret: %v", err)
+	}
+
+	*requestSecretFlag = "s"
+	swapped := body
+	swapped.SourceFiles = []api.SourceFile{{Name: "main.cpp", Text: "int main() { evil(); }"}}
+	if err := verifyExecuteSignature(swapped); err == nil {
+		t.Fatal("swapped sources: expected an error")
+	}
+	impersonated := body
+	impersonated.Requester = "mallory"
+	if err := verifyExecuteSignature(impersonated); err == nil {
+		t.Fatal("changed requester: expected an error")
+	}
+	if err := verifyExecuteSignature(body); err != nil {
+		t.Fatalf("signed request: %v", err)
+	}
+	if err := verifyExecuteSignature(api.ExecuteRequest{Target: "run"}); err == nil {
+		t.Fatal("unsigned request: expected an error")
+	}
+}
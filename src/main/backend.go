@@ -1,52 +1,109 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"sync/atomic"
+	"net"
+	"sync"
 	"time"
 
 	"github.com/practicode-org/worker/src/api"
+	"github.com/practicode-org/worker/src/config"
 	"github.com/practicode-org/worker/src/rules"
+	"github.com/practicode-org/worker/src/tests"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/gorilla/websocket"
 )
 
-func messageRecvLoop(conn *websocket.Conn, messages chan<- []byte, exitSignal int32, exitch chan<- struct{}) {
-	defer func() {
-		exitch <- struct{}{}
-	}()
+// messageRecvLoop passes received messages on until the connection breaks or done is closed
+func messageRecvLoop(conn *websocket.Conn, messages chan<- api.Envelope, sendMessages chan<- interface{}, done <-chan struct{}, exitch chan<- struct{}) {
+	defer close(exitch)
+
+	sendError := func(desc string) {
+		select {
+		case sendMessages <- api.Error{Desc: desc, Stage: "init"}:
+		case <-done:
+		}
+	}
 
+	lastSeq := uint64(1) // the hello message
 	for {
-		// TODO: use conn.readLimit
 		_, data, err := conn.ReadMessage()
 		if err != nil {
-			if _, ok := err.(*websocket.CloseError); ok {
-				log.Warningf("Connection with the backend closed: %s", err)
-				break
-			}
-			if atomic.LoadInt32(&exitSignal) == 1 {
-				break
+			select {
+			case <-done:
+			default:
+				if _, ok := err.(*websocket.CloseError); ok {
+					log.Warningf("Connection with the backend closed: %s", err)
+				} else if err == websocket.ErrReadLimit {
+					log.Errorf("Got a message bigger than %d bytes, closing the connection", *maxMessageSizeFlag)
+				} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					log.Errorf("No messages or pongs for %v, closing the connection", *pingIntervalFlag+*pongTimeoutFlag)
+				} else {
+					log.Errorf("messageRecvLoop: ReadMessage error: %v", err)
+				}
 			}
-			log.Errorf("messageRecvLoop: ReadMessage error: %v", err)
 			break
 		}
+		conn.SetReadDeadline(readDeadline())
 
 		log.Debug("<- received: ", trimLongString(string(data), 194))
 
-		messages <- data
+		env := api.Envelope{}
+		err = json.Unmarshal(data, &env)
+		if err != nil || env.Type == "" {
+			sendError(fmt.Sprintf("Failed to unmarshal message envelope: %s", trimLongString(string(data), 64)))
+			continue
+		}
+		if env.Version != api.ProtocolVersion {
+			str := fmt.Sprintf("Rejected %s message of protocol version %d, the connection uses version %d", env.Type, env.Version, api.ProtocolVersion)
+			if env.Type == api.TypeNew {
+				msg := api.ClientMessage{}
+				json.Unmarshal(env.Payload, &msg)
+				auditRejected(msg.RequestID, msg.Requester, msg.BuildEnv, msg.Target, str)
+			}
+			sendError(str)
+			continue
+		}
+		if env.Seq != lastSeq+1 {
+			log.Warningf("Got message seq %d, expected %d", env.Seq, lastSeq+1)
+		}
+		lastSeq = env.Seq
+
+		select {
+		case messages <- env:
+		case <-done:
+			return
+		}
 	}
 	log.Debugf("Exit from messageRecvLoop")
 }
 
-func messageSendLoop(conn *websocket.Conn, messages <-chan interface{}, exitch chan<- struct{}) {
-	defer func() {
-		exitch <- struct{}{}
-	}()
+// messageSendLoop wraps messages into envelopes numbering them from seq
+func messageSendLoop(conn *websocket.Conn, messages <-chan interface{}, seq uint64, exitch chan<- struct{}) {
+	defer close(exitch)
+
+	var pings <-chan time.Time
+	if *pingIntervalFlag > 0 {
+		ticker := time.NewTicker(*pingIntervalFlag)
+		defer ticker.Stop()
+		pings = ticker.C
+	}
 
 	for {
-		msg := <-messages
+		var msg interface{}
+		select {
+		case msg = <-messages:
+		case <-pings:
+			err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(*writeTimeoutFlag))
+			if err != nil {
+				log.Errorf("Failed to send ping: %v", err)
+				return
+			}
+			continue
+		}
 		if _, close_ := msg.(CloseEvent); close_ {
 			break
 		}
@@ -56,7 +113,14 @@ func messageSendLoop(conn *websocket.Conn, messages <-chan interface{}, exitch c
 			log.Error("Sending error:", errMsg.Desc)
 		}
 
-		bytes, err := json.Marshal(&msg)
+		env, err := api.NewEnvelope(api.MessageType(msg), seq, msg)
+		if err != nil {
+			log.Errorf("Failed to wrap outgoing message: %v\n", err)
+			continue
+		}
+		seq++
+
+		bytes, err := json.Marshal(&env)
 		if err != nil {
 			log.Errorf("Failed to marshal outgoing message: %v\n", err)
 			continue
@@ -64,6 +128,7 @@ func messageSendLoop(conn *websocket.Conn, messages <-chan interface{}, exitch c
 
 		log.Debug("-> sending: ", trimLongString(string(bytes), 64))
 
+		conn.SetWriteDeadline(time.Now().Add(*writeTimeoutFlag))
 		err = conn.WriteMessage(websocket.TextMessage, bytes)
 		if err != nil {
 			log.Errorf("Failed to write to websocket: %v\n", err)
@@ -73,86 +138,398 @@ func messageSendLoop(conn *websocket.Conn, messages <-chan interface{}, exitch c
 	log.Debugf("Exit from messageSendLoop")
 }
 
-func handleBackendConnection(conn *websocket.Conn) {
-	recvMessages := make(chan []byte, 4)
-	recvExited := make(chan struct{})
-	recvExitSignal := int32(0)
-	go messageRecvLoop(conn, recvMessages, recvExitSignal, recvExited)
+// how long the other side has to answer the worker's hello
+const handshakeTimeout = time.Second * 10
 
-	sendMessages := make(chan interface{}, 256)
-	sendExited := make(chan struct{})
-	go messageSendLoop(conn, sendMessages, sendExited)
+// readDeadline is when the connection is considered dead if nothing, not even a pong, comes before it
+func readDeadline() time.Time {
+	if *pingIntervalFlag <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(*pingIntervalFlag + *pongTimeoutFlag)
+}
 
-	for {
-		var bytes []byte
-		exit := false
-		select {
-		case bytes = <-recvMessages:
-		case _ = <-recvExited:
-			exit = true
-		}
-		if exit {
-			break
+// configureConn limits message size and sets up keepalive: the worker pings the other side every ping interval,
+// and any message, ping or pong from it extends the read deadline
+func configureConn(conn *websocket.Conn) {
+	conn.SetReadLimit(*maxMessageSizeFlag)
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(readDeadline())
+	})
+	conn.SetPingHandler(func(data string) error {
+		conn.SetReadDeadline(readDeadline())
+		err := conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(*writeTimeoutFlag))
+		if err == websocket.ErrCloseSent {
+			return nil
 		}
+		return err
+	})
+}
+
+// handshake agrees on the protocol version: the worker sends a hello with versions it supports
+// and the other side must answer with a hello of one of them. Returns seq of the next outgoing message.
+func handshake(conn *websocket.Conn) (uint64, error) {
+	hello, err := api.NewEnvelope(api.TypeHello, 1, api.Hello{Versions: []int{api.ProtocolVersion}})
+	if err != nil {
+		return 0, err
+	}
+	conn.SetWriteDeadline(time.Now().Add(*writeTimeoutFlag))
+	err = conn.WriteJSON(&hello)
+	if err != nil {
+		return 0, fmt.Errorf("failed to send hello: %w", err)
+	}
 
-		// get the first message - it must be {"command":"new","request_id":"..."}
-		msg := api.ClientMessage{}
-		err := json.Unmarshal(bytes, &msg)
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetReadDeadline(readDeadline())
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		return 0, fmt.Errorf("failed to receive hello: %w", err)
+	}
+
+	reply := api.Envelope{}
+	err = json.Unmarshal(data, &reply)
+	if err == nil && reply.Type != api.TypeHello {
+		err = fmt.Errorf("the first message must be %s, got %q", api.TypeHello, reply.Type)
+	} else if err == nil && reply.Version != api.ProtocolVersion {
+		err = fmt.Errorf("unsupported protocol version %d, supported versions: %d", reply.Version, api.ProtocolVersion)
+	}
+	if err != nil {
+		// let the other side know why it's disconnected
+		errMsg, _ := api.NewEnvelope(api.TypeError, 2, api.Error{Desc: fmt.Sprintf("Handshake failed: %v", err), Stage: "init"})
+		conn.SetWriteDeadline(time.Now().Add(*writeTimeoutFlag))
+		conn.WriteJSON(&errMsg)
+		return 0, err
+	}
+	return 2, nil
+}
+
+// capabilities describes loaded build envs and their targets
+func capabilities() api.Capabilities {
+	caps := api.Capabilities{
+		BuildEnvs:             []api.BuildEnv{},
+		CheckTypes:            tests.CheckTypes,
+		MaxSourcesSizeBytes:   config.Cfg.SourcesSizeLimitBytes,
+		MaxSourceFileNameSize: maxSourceFileNameSize,
+	}
+	for _, name := range rules.BuildEnvNames() {
+		buildStages, err := rules.BuildEnv(name)
 		if err != nil {
-			log.Errorf("Failed to unmarshal: %v, message: %s...", err, trimLongString(string(bytes), 64))
 			continue
 		}
+		caps.BuildEnvs = append(caps.BuildEnvs, api.BuildEnv{Name: name, Targets: buildStages.Targets()})
+	}
+	return caps
+}
 
-		log.Debugf("Got new request: %s\n", string(bytes))
-
-		if msg.Command != "new" {
-			log.Errorf("Got wrong first request message: %s...", trimLongString(string(bytes), 64))
-			continue
+// buildEnvForRequest picks a build env by name, an empty name is allowed only if there is exactly one loaded
+func buildEnvForRequest(name string) (*rules.BuildStages, error) {
+	if name == "" {
+		names := rules.BuildEnvNames()
+		if len(names) != 1 {
+			return nil, fmt.Errorf("'build_env' is empty, but %d build envs are loaded", len(names))
 		}
-		// TODO: add accept message
+		name = names[0]
+	}
+	return rules.BuildEnv(name)
+}
 
-		if msg.RequestID == "" {
-			str := fmt.Sprintf("Got empty 'request_id' in the first message: %s...", trimLongString(string(bytes), 64))
-			log.Error(str)
-			sendMessages <- api.Error{Desc: str, Stage: "init", RequestID: msg.RequestID}
-			sendMessages <- api.Finish{Finish: true, RequestID: msg.RequestID}
-			continue
+// backendRequest is a request running on its own, so it can outlive the connection it came from.
+// Its outgoing messages are kept until a connection takes them.
+type backendRequest struct {
+	requestID string
+	cancel    context.CancelFunc
+
+	mu       sync.Mutex
+	inbox    []api.Envelope // client messages the request hasn't read yet, ex: stop
+	received chan struct{}  // signalled when inbox grows
+	pending  []interface{}
+	notify   chan struct{} // signalled when pending grows
+	taken    *sync.Cond    // signalled when pending is taken
+	finished bool          // Finish is in pending or has been taken
+}
+
+// the request waits when that many of its messages haven't been taken yet, so output of a program
+// piles up in its spool (which drops what doesn't fit) instead of here
+const maxPendingMessages = 256
+
+func startBackendRequest(msg api.ClientMessage, stages []*rules.Stage) *backendRequest {
+	ctx, cancel := context.WithCancel(contextWithTraceParent(context.Background(), msg.TraceParent, msg.TraceState))
+	r := &backendRequest{
+		requestID: msg.RequestID,
+		cancel:    cancel,
+		received:  make(chan struct{}, 1),
+		notify:    make(chan struct{}, 1),
+	}
+	r.taken = sync.NewCond(&r.mu)
+	recvMessages := make(chan api.Envelope)
+	sendMessages := make(chan interface{}, 256)
+	go handleRequest(ctx, msg.RequestID, msg.BuildEnv, msg.Target, msg.Requester, msg.SourcesHash, stages, recvMessages, sendMessages)
+	go r.forwardInbox(ctx, recvMessages)
+	go func() {
+		defer cancel()
+		for msg := range sendMessages {
+			_, finish := msg.(api.Finish)
+			r.mu.Lock()
+			for len(r.pending) >= maxPendingMessages {
+				r.taken.Wait()
+			}
+			r.pending = append(r.pending, msg)
+			r.finished = r.finished || finish
+			r.mu.Unlock()
+			select {
+			case r.notify <- struct{}{}:
+			default:
+			}
+			if finish {
+				return
+			}
 		}
-		if msg.Target == "" {
-			str := fmt.Sprintf("Got empty 'target' in the first message: %s...", trimLongString(string(bytes), 64))
-			log.Error(str)
-			sendMessages <- api.Error{Desc: str, Stage: "init", RequestID: msg.RequestID}
-			sendMessages <- api.Finish{Finish: true, RequestID: msg.RequestID}
-			continue
+	}()
+	return r
+}
+
+// deliver queues a client message for the request, it doesn't wait for the request to read it
+func (r *backendRequest) deliver(env api.Envelope) {
+	r.mu.Lock()
+	r.inbox = append(r.inbox, env)
+	r.mu.Unlock()
+	select {
+	case r.received <- struct{}{}:
+	default:
+	}
+}
+
+// forwardInbox passes queued client messages to the request in order until it's finished
+func (r *backendRequest) forwardInbox(ctx context.Context, recvMessages chan<- api.Envelope) {
+	for {
+		r.mu.Lock()
+		msgs := r.inbox
+		r.inbox = nil
+		r.mu.Unlock()
+		for _, env := range msgs {
+			select {
+			case recvMessages <- env:
+			case <-ctx.Done():
+				return
+			}
 		}
-		if msg.SourceFiles != nil {
-			str := "Got unexpected source_files content in the first message from the backend"
-			log.Error(str)
-			sendMessages <- api.Error{Desc: str, Stage: "init", RequestID: msg.RequestID}
-			sendMessages <- api.Finish{Finish: true, RequestID: msg.RequestID}
-			continue
+		select {
+		case <-r.received:
+		case <-ctx.Done():
+			return
 		}
-		stages, err := rules.StagesForTarget(msg.Target)
+	}
+}
+
+// take returns messages sent since the last call and whether the request has finished
+func (r *backendRequest) take() ([]interface{}, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	msgs := r.pending
+	r.pending = nil
+	r.taken.Broadcast()
+	return msgs, r.finished
+}
+
+// backendSession keeps state between connections to the backend
+type backendSession struct {
+	// keep the request running when the connection is lost and send its results after reconnecting,
+	// otherwise the request is stopped
+	resume bool
+	active *backendRequest
+}
+
+// newRequest checks the "new" message and returns the request and its stages,
+// or a description of the problem to send back
+func newRequest(env api.Envelope, defaultBuildEnv string) (api.ClientMessage, []*rules.Stage, string) {
+	bytes := env.Payload
+	msg := api.ClientMessage{}
+	err := json.Unmarshal(bytes, &msg)
+	if err != nil {
+		return msg, nil, fmt.Sprintf("Failed to unmarshal: %v, message: %s...", err, trimLongString(string(bytes), 64))
+	}
+
+	log.Debugf("Got new request: %s\n", string(bytes))
+
+	if msg.RequestID == "" {
+		return msg, nil, fmt.Sprintf("Got empty 'request_id' in the first message: %s...", trimLongString(string(bytes), 64))
+	}
+	if msg.Target == "" {
+		return msg, nil, fmt.Sprintf("Got empty 'target' in the first message: %s...", trimLongString(string(bytes), 64))
+	}
+	if msg.SourceFiles != nil {
+		return msg, nil, "Got unexpected source_files content in the first message from the backend"
+	}
+	if *requestSecretFlag != "" {
+		err = verifyRequestSignature(*requestSecretFlag, msg)
 		if err != nil {
-			str := fmt.Sprintf("Failed to figure out rules for target %s: %v", msg.Target, err)
-			log.Error(str)
-			sendMessages <- api.Error{Desc: str, Stage: "init", RequestID: msg.RequestID}
-			sendMessages <- api.Finish{Finish: true, RequestID: msg.RequestID}
-			continue
+			return msg, nil, fmt.Sprintf("Rejected request: %v", err)
+		}
+	}
+	if msg.BuildEnv == "" {
+		msg.BuildEnv = defaultBuildEnv
+	}
+	buildStages, err := buildEnvForRequest(msg.BuildEnv)
+	if err != nil {
+		return msg, nil, fmt.Sprintf("Failed to pick build env: %v", err)
+	}
+	stages, err := buildStages.StagesForTarget(msg.Target)
+	if err != nil {
+		return msg, nil, fmt.Sprintf("Failed to figure out rules for target %s: %v", msg.Target, err)
+	}
+	msg.BuildEnv = buildStages.Name
+	return msg, stages, ""
+}
+
+// handleBackendConnection serves requests coming through the connection one by one,
+// defaultBuildEnv is used for requests which don't specify a build env.
+// Returns false if the connection failed before the handshake was done.
+func handleBackendConnection(conn *websocket.Conn, defaultBuildEnv string, session *backendSession) bool {
+	configureConn(conn)
+	seq, err := handshake(conn)
+	if err != nil {
+		log.Errorf("Handshake with %s failed: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return false
+	}
+
+	// unbuffered, so messages of a request aren't lost in the channel if the connection breaks,
+	// they stay with the request until the send loop takes them
+	done := make(chan struct{})
+	sendMessages := make(chan interface{})
+	sendExited := make(chan struct{})
+	go messageSendLoop(conn, sendMessages, seq, sendExited)
+
+	recvMessages := make(chan api.Envelope, 4)
+	recvExited := make(chan struct{})
+	go messageRecvLoop(conn, recvMessages, sendMessages, done, recvExited)
+
+	// send returns false if the connection is lost
+	send := func(msg interface{}) bool {
+		select {
+		case sendMessages <- msg:
+			return true
+		case <-sendExited:
+			return false
 		}
+	}
 
-		handleRequest(msg.RequestID, msg.Target, stages, recvMessages, sendMessages)
+	drain.openConn()
+	defer drain.closeConn()
+	websocketConnections.Inc()
+	defer websocketConnections.Dec()
+
+	// capabilities are sent again whenever rules are reloaded
+	reloaded := rulesReloaded.subscribe()
+	defer rulesReloaded.unsubscribe(reloaded)
+	connected := send(capabilities())
+	active := session.active
+	if active != nil {
+		log.Infof("Resuming request %s", active.requestID)
+		select {
+		case active.notify <- struct{}{}: // deliver what was sent while disconnected
+		default:
+		}
+	}
+
+	drainStarted := drain.started
+	closing := false // the worker is draining, close the connection once there's no running request
+	for connected && !(closing && active == nil) {
+		var notify <-chan struct{}
+		if active != nil {
+			notify = active.notify
+		}
+
+		select {
+		case <-reloaded:
+			connected = send(capabilities())
+		case <-drainStarted:
+			drainStarted = nil
+			closing = true
+			connected = send(api.Draining{TimeLeftSec: drain.timeLeft().Seconds()})
+		case env := <-recvMessages:
+			if env.Type == api.TypeNew && active != nil {
+				msg := api.ClientMessage{}
+				json.Unmarshal(env.Payload, &msg)
+				str := fmt.Sprintf("Request %s is still running", active.requestID)
+				log.Error(str)
+				auditRejected(msg.RequestID, msg.Requester, msg.BuildEnv, msg.Target, str)
+				connected = send(api.Error{Desc: str, Stage: "init", RequestID: msg.RequestID}) &&
+					send(api.Finish{Finish: true, RequestID: msg.RequestID})
+				continue
+			}
+			if active != nil {
+				active.deliver(env)
+				continue
+			}
+
+			// get the first message - it must be "new" with {"request_id":"...","target":"..."}
+			if env.Type != api.TypeNew {
+				log.Errorf("Got wrong first request message %q: %s...", env.Type, trimLongString(string(env.Payload), 64))
+				continue
+			}
+			msg, stages, str := newRequest(env, defaultBuildEnv)
+			if str != "" {
+				log.Error(str)
+				auditRejected(msg.RequestID, msg.Requester, msg.BuildEnv, msg.Target, str)
+				connected = send(api.Error{Desc: str, Stage: "init", RequestID: msg.RequestID}) &&
+					send(api.Finish{Finish: true, RequestID: msg.RequestID})
+				continue
+			}
+			active = startBackendRequest(msg, stages)
+			session.active = active
+		case <-notify:
+			msgs, finished := active.take()
+			for i, msg := range msgs {
+				if !send(msg) {
+					// put back what wasn't sent, the order doesn't change as nobody else takes messages
+					active.mu.Lock()
+					active.pending = append(msgs[i:], active.pending...)
+					active.mu.Unlock()
+					connected = false
+					break
+				}
+			}
+			if connected && finished {
+				active = nil
+				session.active = nil
+			}
+		case <-recvExited:
+			connected = false
+		case <-sendExited:
+			connected = false
+		}
 	}
 
 	log.Debugf("Start cleanup at handleBackendConnection")
 
-	sendMessages <- CloseEvent{}
+	if active != nil {
+		if session.resume {
+			log.Warningf("Lost connection during request %s, it keeps running and its results will be sent after reconnecting", active.requestID)
+		} else {
+			log.Warningf("Lost connection during request %s, stopping it", active.requestID)
+			active.cancel()
+			for {
+				if _, finished := active.take(); finished {
+					break
+				}
+				<-active.notify
+			}
+			session.active = nil
+		}
+	}
+
+	select {
+	case sendMessages <- CloseEvent{}:
+	case <-sendExited:
+	}
 	<-sendExited
 	time.Sleep(time.Millisecond * 1) // TODO: hack, otherwise connection is closed faster than messages are sent
-	close(sendMessages)
 
+	close(done)
 	conn.Close()
-	close(recvMessages)
+	<-recvExited
 
 	log.Debugf("Exit from handleBackendConnection")
+	return true
 }
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/practicode-org/worker/src/api"
+)
+
+func TestBackendRequestInbox(t *testing.T) {
+	// messages are queued while the request doesn't read them, none is dropped
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := &backendRequest{received: make(chan struct{}, 1)}
+	recvMessages := make(chan api.Envelope)
+	go r.forwardInbox(ctx, recvMessages)
+
+	const count = 20
+	for i := 0; i < count; i++ {
+		r.deliver(api.Envelope{Type: api.TypeStop, Seq: uint64(i)})
+	}
+	for i := 0; i < count; i++ {
+		select {
+		case env := <-recvMessages:
+			if env.Seq != uint64(i) {
+				t.Fatalf("got message %d, want %d", env.Seq, i)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("message %d wasn't forwarded", i)
+		}
+	}
+}
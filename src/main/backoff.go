@@ -0,0 +1,36 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// a backend connection which lasted that long resets reconnect delays
+const stableConnectionTime = time.Minute
+
+// backoff gives exponentially growing delays between reconnects, randomized so that
+// many workers don't dial the backend at the same moment after it restarts
+type backoff struct {
+	min     time.Duration
+	max     time.Duration
+	current time.Duration
+}
+
+// next returns a delay between half and all of the current one, which doubles every call up to max
+func (b *backoff) next() time.Duration {
+	if b.current == 0 {
+		b.current = b.min
+	} else {
+		b.current *= 2
+	}
+	if b.current > b.max {
+		b.current = b.max
+	}
+	half := b.current / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// reset starts over from min delay
+func (b *backoff) reset() {
+	b.current = 0
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/practicode-org/worker/src/api"
+	"github.com/practicode-org/worker/src/config"
+	"github.com/practicode-org/worker/src/rules"
+)
+
+type submission struct {
+	Student   string
+	FilePaths []string
+}
+
+// gradeReport is a result of grading a single submission
+type gradeReport struct {
+	Student string `json:"student"`
+	// "graded" - every stage ran, see test results
+	// "failed" - some stage failed before tests, ex: compilation error
+	// "error" - the submission couldn't be run at all
+	Status      string            `json:"status"`
+	Error       string            `json:"error,omitempty"`
+	Passed      int               `json:"passed"`
+	Total       int               `json:"total"`
+	Score       float64           `json:"score"` // passed / total
+	DurationSec float64           `json:"duration_sec"`
+	MaxRSSKb    int64             `json:"max_rss_kb"`
+	CPUTimeSec  float64           `json:"cpu_time_sec"`
+	Cases       []bool            `json:"cases"` // result of every test case, not run ones are false
+	Stages      []api.StageResult `json:"stages"`
+}
+
+// listSubmissions treats every subdirectory as a student's submission with all files in it as sources,
+// and every file in the directory itself as a single file submission
+func listSubmissions(dir string) ([]submission, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read submissions directory: %w", err)
+	}
+
+	submissions := []submission{}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		if !entry.IsDir() {
+			student := strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name()))
+			submissions = append(submissions, submission{Student: student, FilePaths: []string{path}})
+			continue
+		}
+
+		files, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read submission: %w", err)
+		}
+		sub := submission{Student: entry.Name()}
+		for _, file := range files {
+			if file.Mode().IsRegular() && !strings.HasPrefix(file.Name(), ".") {
+				sub.FilePaths = append(sub.FilePaths, filepath.Join(path, file.Name()))
+			}
+		}
+		submissions = append(submissions, sub)
+	}
+	return submissions, nil
+}
+
+func gradeSubmission(ctx context.Context, sub submission, buildEnv string, target string, suite *api.TestSuite) gradeReport {
+	report := gradeReport{Student: sub.Student, Status: "graded", Cases: []bool{}, Stages: []api.StageResult{}}
+	if suite != nil {
+		report.Total = len(suite.TestCases)
+		report.Cases = make([]bool, len(suite.TestCases))
+	}
+
+	sourceFiles, err := readSourceFiles(sub.FilePaths)
+	if err == nil && len(sourceFiles) == 0 {
+		err = fmt.Errorf("no source files")
+	}
+	if err != nil {
+		report.Status = "error"
+		report.Error = err.Error()
+		return report
+	}
+
+	req := localRequest{
+		RequestID:   fmt.Sprintf("grade-%s-%d", sub.Student, time.Now().UnixNano()),
+		BuildEnv:    buildEnv,
+		Target:      target,
+		TestSuite:   suite,
+		SourceFiles: sourceFiles,
+	}
+	buildStages, stages, err := resolveLocalRequest(req)
+	if err != nil {
+		report.Status = "error"
+		report.Error = err.Error()
+		return report
+	}
+
+	result := newRequestResult(req.RequestID, buildStages, target)
+	err = executeLocal(ctx, req, buildStages, stages, result.add)
+	if err != nil {
+		report.Status = "error"
+		report.Error = err.Error()
+		return report
+	}
+
+	response := result.Response()
+	report.Stages = response.Stages
+	for _, stage := range response.Stages {
+		report.DurationSec += stage.DurationSec
+		report.CPUTimeSec += stage.CPUTimeSec
+		if stage.MaxRSSKb > report.MaxRSSKb {
+			report.MaxRSSKb = stage.MaxRSSKb
+		}
+	}
+	testsRan := false
+	for _, testResult := range response.TestResults {
+		if testResult.Stage == "init" {
+			continue
+		}
+		testsRan = true
+		idx, err := strconv.Atoi(testResult.TestCase)
+		if err != nil || idx < 0 || idx >= len(report.Cases) {
+			continue
+		}
+		report.Cases[idx] = testResult.Result
+		if testResult.Result {
+			report.Passed++
+		}
+	}
+	if len(response.Errors) != 0 {
+		report.Status = "error"
+		report.Error = response.Errors[0].Desc
+	} else if !response.Success && !testsRan {
+		report.Status = "failed"
+	}
+	if report.Total != 0 {
+		report.Score = float64(report.Passed) / float64(report.Total)
+	} else if response.Success {
+		report.Score = 1
+	}
+	return report
+}
+
+func writeCSVReport(w io.Writer, reports []gradeReport, totalCases int) error {
+	writer := csv.NewWriter(w)
+	header := []string{"student", "status", "score", "passed", "total", "duration_sec", "max_rss_kb", "cpu_time_sec", "error"}
+	for i := 0; i < totalCases; i++ {
+		header = append(header, fmt.Sprintf("case_%d", i))
+	}
+	writer.Write(header)
+
+	for _, report := range reports {
+		row := []string{
+			report.Student,
+			report.Status,
+			strconv.FormatFloat(report.Score, 'f', 3, 64),
+			strconv.Itoa(report.Passed),
+			strconv.Itoa(report.Total),
+			strconv.FormatFloat(report.DurationSec, 'f', 3, 64),
+			strconv.FormatInt(report.MaxRSSKb, 10),
+			strconv.FormatFloat(report.CPUTimeSec, 'f', 3, 64),
+			report.Error,
+		}
+		for i := 0; i < totalCases; i++ {
+			if i < len(report.Cases) && report.Cases[i] {
+				row = append(row, "pass")
+			} else {
+				row = append(row, "fail")
+			}
+		}
+		writer.Write(row)
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// runGrade runs every submission in a directory through the rules and writes a report, returns exit status
+func runGrade(args []string) int {
+	flags := flag.NewFlagSet("grade", flag.ExitOnError)
+	rulesDir := flags.String("rules-dir", "", "directory with .yml rules files")
+	buildEnv := flags.String("env", "", "name of the build env (can be omitted if rules-dir has only one)")
+	target := flags.String("target", "", "name of the target stage, ex: run_tests")
+	testsFile := flags.String("tests", "", "test suite JSON file, required for test targets")
+	parallel := flags.Int("parallel", 1, "how many submissions to run at the same time, more than 1 is safe only if stages write only to {out}")
+	reportFile := flags.String("report", "", "report file, .csv or .json (stdout if empty)")
+	format := flags.String("format", "", "report format: csv or json (taken from the report file extension if empty)")
+	logLevel := flags.String("log-level", "warn", "verbosity level: panic, fatal, error, warn, info, debug, trace")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s grade -rules-dir <dir> [-env <build-env>] -target <target> [-tests <suite.json>] [-parallel <n>] [-report <file>] <submissions dir>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	config.AddFlags(flags)
+	err := parseCommandFlags(flags, args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Config error: %v\n", err)
+		return 2
+	}
+
+	if *rulesDir == "" || *target == "" || flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	if *format == "" {
+		*format = strings.TrimPrefix(filepath.Ext(*reportFile), ".")
+		if *format == "" {
+			*format = "csv"
+		}
+	}
+	if *format != "csv" && *format != "json" {
+		fmt.Fprintf(os.Stderr, "Unknown report format %s\n", *format)
+		return 2
+	}
+	level, err := log.ParseLevel(*logLevel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to parse log-level: %v\n", err)
+		return 2
+	}
+	log.SetLevel(level)
+
+	err = config.Validate(flags, settingLimits)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Config error: %v\n", err)
+		return 2
+	}
+	var buildEnvNames []string
+	if *buildEnv != "" {
+		buildEnvNames = []string{*buildEnv}
+	}
+	err = rules.LoadBuildEnvs(*rulesDir, buildEnvNames)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	var suite *api.TestSuite
+	if *testsFile != "" {
+		suite, err = readTestSuite(*testsFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		suite.RunAllTestCases = true // the score counts every passed test case
+	}
+	submissions, err := listSubmissions(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	sort.Slice(submissions, func(i, j int) bool { return submissions[i].Student < submissions[j].Student })
+
+	// Ctrl+C stops running submissions, the rest are reported as errors
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	setRequestConcurrency(*parallel)
+	reports := make([]gradeReport, len(submissions))
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < *parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range queue {
+				reports[idx] = gradeSubmission(ctx, submissions[idx], *buildEnv, *target, suite)
+				report := reports[idx]
+				fmt.Fprintf(os.Stderr, "%s: %s, %d/%d passed\n", report.Student, report.Status, report.Passed, report.Total)
+			}
+		}()
+	}
+	for i := range submissions {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+
+	out := os.Stdout
+	if *reportFile != "" {
+		out, err = os.Create(*reportFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to create report: %v\n", err)
+			return 2
+		}
+		defer out.Close()
+	}
+
+	totalCases := 0
+	if suite != nil {
+		totalCases = len(suite.TestCases)
+	}
+	if *format == "json" {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(reports)
+	} else {
+		err = writeCSVReport(out, reports, totalCases)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write report: %v\n", err)
+		return 2
+	}
+	return 0
+}
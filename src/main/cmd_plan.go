@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/practicode-org/worker/src/config"
+	"github.com/practicode-org/worker/src/rules"
+)
+
+// runPlan prints stages which would run for a target and their nsjail command lines, returns exit status
+func runPlan(args []string) int {
+	flags := flag.NewFlagSet("plan", flag.ExitOnError)
+	rulesDir := flags.String("rules-dir", "", "directory with .yml rules files")
+	sources := flags.String("sources", "", "comma-separated source file paths to substitute for {sources} (kept as is if empty)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s plan -rules-dir <dir> [-sources <files>] <build-env> <target>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	config.AddFlags(flags) // nsjail-path is a part of the printed command lines
+	err := parseCommandFlags(flags, args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Config error: %v\n", err)
+		return 2
+	}
+
+	if *rulesDir == "" || flags.NArg() != 2 {
+		flags.Usage()
+		return 2
+	}
+	buildEnvName, target := flags.Arg(0), flags.Arg(1)
+
+	err = rules.LoadBuildEnvs(*rulesDir, []string{buildEnvName})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	buildStages, err := rules.BuildEnv(buildEnvName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	stages, err := buildStages.StagesForTarget(target)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	sourceFiles := []string{"{sources}"}
+	if *sources != "" {
+		sourceFiles = strings.Split(*sources, ",")
+	}
+
+	fmt.Printf("build env: %s, target: %s\n", buildEnvName, target)
+	for i, layer := range rules.Layers(stages) {
+		names := make([]string, 0, len(layer))
+		for _, stage := range layer {
+			names = append(names, stage.Name)
+		}
+		if len(layer) > 1 {
+			fmt.Printf("\n%d. %s (in parallel)\n", i+1, strings.Join(names, ", "))
+		} else {
+			fmt.Printf("\n%d. %s\n", i+1, names[0])
+		}
+
+		for _, stage := range layer {
+			jailedCommand, _ := wrapToJail(stage.Command, stage.Env, stage.Mounts, stage.Limits, jailPaths{sourceFiles: sourceFiles, outDir: "{out}"})
+			fmt.Printf("  %s:\n", stage.Name)
+			if len(stage.DependsOn) != 0 {
+				fmt.Printf("    depends on: %s\n", strings.Join(stage.DependsOn, ", "))
+			}
+			policies := []string{}
+			if stage.ContinueOnFailure {
+				policies = append(policies, "continue_on_failure")
+			}
+			if stage.AlwaysRun {
+				policies = append(policies, "always_run")
+			}
+			if len(stage.AllowedExitCodes) != 0 {
+				policies = append(policies, fmt.Sprintf("allowed_exit_codes %v", stage.AllowedExitCodes))
+			}
+			if len(policies) != 0 {
+				fmt.Printf("    policies: %s\n", strings.Join(policies, ", "))
+			}
+			if stage.Name == target && targetHasTests(target) {
+				fmt.Printf("    runs once per test case\n")
+			}
+			fmt.Printf("    command: %s\n", jailedCommand)
+		}
+	}
+	return 0
+}
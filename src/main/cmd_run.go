@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/practicode-org/worker/src/api"
+	"github.com/practicode-org/worker/src/config"
+	"github.com/practicode-org/worker/src/rules"
+)
+
+// readTestSuite reads a test suite JSON file, the same message a backend sends
+func readTestSuite(filePath string) (*api.TestSuite, error) {
+	bytes, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read test suite: %w", err)
+	}
+	suite := &api.TestSuite{}
+	err = json.Unmarshal(bytes, suite)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal test suite %s: %w", filePath, err)
+	}
+	return suite, nil
+}
+
+// readSourceFiles reads source files from disk, names of the files are used as source file names
+func readSourceFiles(filePaths []string) ([]api.SourceFile, error) {
+	sourceFiles := make([]api.SourceFile, 0, len(filePaths))
+	for _, filePath := range filePaths {
+		text, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read source file: %w", err)
+		}
+		sourceFiles = append(sourceFiles, api.SourceFile{Name: filepath.Base(filePath), Text: string(text)})
+	}
+	return sourceFiles, nil
+}
+
+// printMessage prints an outgoing message for a human, program output goes to stdout or stderr as is
+func printMessage(msg interface{}) {
+	switch m := msg.(type) {
+	case api.Accepted:
+		names := make([]string, 0, len(m.Stages))
+		for _, stage := range m.Stages {
+			names = append(names, stage.Name)
+		}
+		fmt.Fprintf(os.Stderr, "=== accepted, stages: %s\n", strings.Join(names, ", "))
+	case api.StageEvent:
+		if m.TestCase != "" {
+			fmt.Fprintf(os.Stderr, "=== %s: %s, test case #%s\n", m.Stage, m.Event, m.TestCase)
+		} else {
+			fmt.Fprintf(os.Stderr, "=== %s: %s\n", m.Stage, m.Event)
+		}
+	case api.Output:
+		text, err := base64.StdEncoding.DecodeString(m.Text)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "=== %s: failed to decode output: %v\n", m.Stage, err)
+			return
+		}
+		if m.Type == "stderr" {
+			os.Stderr.Write(text)
+		} else {
+			os.Stdout.Write(text)
+		}
+	case api.OutputDropped:
+		fmt.Fprintf(os.Stderr, "=== %s: %d bytes of output dropped\n", m.Stage, m.DroppedBytes)
+	case api.ExitCode:
+		fmt.Fprintf(os.Stderr, "=== %s: exit code %d\n", m.Stage, m.ExitCode)
+	case api.Duration:
+		fmt.Fprintf(os.Stderr, "=== %s: took %.2f sec\n", m.Stage, m.DurationSec)
+	case api.ResourceUsage:
+		fmt.Fprintf(os.Stderr, "=== %s: max RSS %d kb, CPU time %.2f sec\n", m.Stage, m.MaxRSSKb, m.CPUTimeSec)
+	case api.TestResult:
+		result := "FAIL"
+		if m.Result {
+			result = "PASS"
+		}
+		fmt.Fprintf(os.Stderr, "=== %s: test case #%s %s\n", m.Stage, m.TestCase, result)
+	case api.Error:
+		fmt.Fprintf(os.Stderr, "=== %s: error: %s\n", m.Stage, m.Desc)
+	}
+}
+
+// runRun executes a single request locally without a backend and prints its output, returns exit status:
+// 0 if every stage and test case succeeded, 1 if something failed, 2 if the request couldn't be run at all
+func runRun(args []string) int {
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	rulesDir := flags.String("rules-dir", "", "directory with .yml rules files")
+	buildEnv := flags.String("env", "", "name of the build env (can be omitted if rules-dir has only one)")
+	target := flags.String("target", "", "name of the target stage, ex: run_tests")
+	testsFile := flags.String("tests", "", "test suite JSON file, required for test targets")
+	logLevel := flags.String("log-level", "warn", "verbosity level: panic, fatal, error, warn, info, debug, trace")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s run -rules-dir <dir> [-env <build-env>] -target <target> [-tests <suite.json>] <source files...>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	config.AddFlags(flags)
+	err := parseCommandFlags(flags, args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Config error: %v\n", err)
+		return 2
+	}
+
+	if *rulesDir == "" || *target == "" || flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+	level, err := log.ParseLevel(*logLevel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to parse log-level: %v\n", err)
+		return 2
+	}
+	log.SetLevel(level)
+
+	err = config.Validate(flags, settingLimits)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Config error: %v\n", err)
+		return 2
+	}
+
+	var buildEnvNames []string
+	if *buildEnv != "" {
+		buildEnvNames = []string{*buildEnv}
+	}
+	err = rules.LoadBuildEnvs(*rulesDir, buildEnvNames)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	req := localRequest{
+		RequestID: fmt.Sprintf("local-%d", time.Now().UnixNano()),
+		BuildEnv:  *buildEnv,
+		Target:    *target,
+	}
+	if *testsFile != "" {
+		req.TestSuite, err = readTestSuite(*testsFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+	req.SourceFiles, err = readSourceFiles(flags.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	buildStages, stages, err := resolveLocalRequest(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	result := newRequestResult(req.RequestID, buildStages, req.Target)
+
+	// Ctrl+C stops the request instead of killing the worker with jails left behind
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	err = executeLocal(ctx, req, buildStages, stages, func(msg interface{}) {
+		printMessage(msg)
+		result.add(msg)
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if ctx.Err() != nil || result.Failed() {
+		return 1
+	}
+	return 0
+}
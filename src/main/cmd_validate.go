@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/practicode-org/worker/src/rules"
+)
+
+// runValidate loads and checks every build env in a rules directory, returns exit status
+func runValidate(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	rulesDir := flags.String("rules-dir", "", "directory with .yml rules files")
+	buildEnvNames := flags.String("build-env", "", "comma-separated names of build envs to check (all from rules-dir if empty)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s validate -rules-dir <dir> [-build-env <names>]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	err := parseCommandFlags(flags, args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Config error: %v\n", err)
+		return 2
+	}
+
+	if *rulesDir == "" {
+		flags.Usage()
+		return 2
+	}
+
+	var names []string
+	if *buildEnvNames != "" {
+		names = strings.Split(*buildEnvNames, ",")
+	}
+	err = rules.LoadBuildEnvs(*rulesDir, names)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	fmt.Printf("OK: %s\n", strings.Join(rules.BuildEnvNames(), ", "))
+	return 0
+}
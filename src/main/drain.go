@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// after the drain deadline stopped requests and connections get that long to send their results
+const drainKillGrace = time.Second * 10
+
+var errDrainDeadline = errors.New("the worker is shutting down")
+
+// drainer tracks running requests and open connections, so on shutdown the worker can stop taking
+// new requests and let the running ones finish
+type drainer struct {
+	mu       sync.Mutex
+	draining bool
+	deadline time.Time // running requests are stopped at that time
+	requests int
+	conns    int
+	changed  chan struct{} // signalled when requests or conns go down
+	started  chan struct{} // closed when draining starts
+	kill     chan struct{} // closed when the deadline passes, running requests get stopped
+	done     chan struct{} // closed when draining is over
+}
+
+var drain = newDrainer()
+
+func newDrainer() *drainer {
+	return &drainer{
+		changed: make(chan struct{}, 1),
+		started: make(chan struct{}),
+		kill:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+func (d *drainer) signal() {
+	select {
+	case d.changed <- struct{}{}:
+	default:
+	}
+}
+
+// startRequest registers a running request, returns false if the worker is draining
+func (d *drainer) startRequest() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.draining {
+		return false
+	}
+	d.requests++
+	return true
+}
+
+func (d *drainer) endRequest() {
+	d.mu.Lock()
+	d.requests--
+	d.mu.Unlock()
+	d.signal()
+}
+
+func (d *drainer) openConn() {
+	d.mu.Lock()
+	d.conns++
+	d.mu.Unlock()
+}
+
+func (d *drainer) closeConn() {
+	d.mu.Lock()
+	d.conns--
+	d.mu.Unlock()
+	d.signal()
+}
+
+// requestCount returns the number of running requests, including ones waiting for a slot
+func (d *drainer) requestCount() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.requests
+}
+
+func (d *drainer) isDraining() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.draining
+}
+
+// timeLeft returns time until running requests are stopped
+func (d *drainer) timeLeft() time.Duration {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return time.Until(d.deadline)
+}
+
+// waitIdle waits until no requests are running (and no connections are open if conns is set),
+// returns false if it didn't happen in time
+func (d *drainer) waitIdle(timeout time.Duration, conns bool) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		d.mu.Lock()
+		idle := d.requests == 0 && (!conns || d.conns == 0)
+		d.mu.Unlock()
+		if idle {
+			return true
+		}
+		select {
+		case <-d.changed:
+		case <-timer.C:
+			return false
+		}
+	}
+}
+
+// run stops taking new requests, waits up to timeout for the running ones, stops those which are still running
+// and waits for connections to send the results
+func (d *drainer) run(timeout time.Duration) {
+	d.mu.Lock()
+	d.draining = true
+	d.deadline = time.Now().Add(timeout)
+	requests := d.requests
+	d.mu.Unlock()
+	close(d.started)
+
+	log.Infof("Draining: not taking new requests, waiting up to %v for %d running ones", timeout, requests)
+	if !d.waitIdle(timeout, false) {
+		log.Warningf("Drain timeout has passed, stopping running requests")
+		close(d.kill)
+	}
+	if !d.waitIdle(drainKillGrace, true) {
+		log.Warningf("Some requests or connections are still open, exiting anyway")
+	}
+	log.Infof("Drained")
+	close(d.done)
+}
+
+// drainOnSignal drains the worker on SIGTERM or SIGINT, a second signal kills it right away
+func drainOnSignal(timeout time.Duration) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+	signal.Stop(signals)
+	log.Infof("Got %v, shutting down", sig)
+	drain.run(timeout)
+}
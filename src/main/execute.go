@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/propagation"
+
+	"github.com/practicode-org/worker/src/api"
+)
+
+// sources, test suite and JSON overhead together are way below that
+const maxExecuteBodyBytes = 4 * 1024 * 1024
+
+func writeJSONResponse(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(body)
+	if err != nil {
+		log.Errorf("Failed to write response: %v", err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, requestID string, desc string) {
+	writeJSONResponse(w, status, api.Error{Desc: desc, Stage: "init", RequestID: requestID})
+}
+
+// decodeJSONBody strictly decodes a size limited request body
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxExecuteBodyBytes))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(v)
+	if err != nil {
+		return fmt.Errorf("failed to decode request: %w", err)
+	}
+	return nil
+}
+
+// newLocalRequest turns an api.ExecuteRequest into a localRequest, generating a request id if it's not set
+func newLocalRequest(body api.ExecuteRequest, requestIDPrefix string) localRequest {
+	req := localRequest{
+		RequestID:   body.RequestID,
+		BuildEnv:    body.BuildEnv,
+		Target:      body.Target,
+		Requester:   body.Requester,
+		TestSuite:   body.TestSuite,
+		SourceFiles: body.SourceFiles,
+	}
+	if req.RequestID == "" {
+		req.RequestID = fmt.Sprintf("%s-%d", requestIDPrefix, time.Now().UnixNano())
+	}
+	return req
+}
+
+// handleExecute runs the whole request synchronously and returns all of its results in one response
+func handleExecute(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSONError(w, http.StatusMethodNotAllowed, "", "only POST is allowed")
+		return
+	}
+
+	body := api.ExecuteRequest{}
+	err := decodeJSONBody(w, r, &body)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "", err.Error())
+		return
+	}
+	err = verifyExecuteSignature(body)
+	if err != nil {
+		auditRejected(body.RequestID, body.Requester, body.BuildEnv, body.Target, fmt.Sprintf("Rejected request: %v", err))
+		writeJSONError(w, http.StatusUnauthorized, body.RequestID, fmt.Sprintf("Rejected request: %v", err))
+		return
+	}
+	req := newLocalRequest(body, "http")
+
+	buildStages, stages, err := resolveLocalRequest(req)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, req.RequestID, err.Error())
+		return
+	}
+	result := newRequestResult(req.RequestID, buildStages, req.Target)
+
+	log.Infof("Got execute request %s from %s", req.RequestID, r.RemoteAddr)
+
+	// the request gets stopped if the client goes away, its spans continue the trace of traceparent header
+	ctx := propagation.TraceContext{}.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	err = executeLocal(ctx, req, buildStages, stages, result.add)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, req.RequestID, err.Error())
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, result.Response())
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/practicode-org/worker/src/api"
+	"github.com/practicode-org/worker/src/api/workerpb"
+)
+
+// grpcServer serves the same requests as websockets, but over gRPC
+type grpcServer struct {
+	workerpb.UnimplementedWorkerServer
+
+	mu      sync.Mutex
+	running map[string]context.CancelFunc // request id -> stops the request
+}
+
+func newGRPCServer() *grpcServer {
+	return &grpcServer{running: make(map[string]context.CancelFunc)}
+}
+
+func (s *grpcServer) GetCapabilities(ctx context.Context, in *workerpb.GetCapabilitiesRequest) (*workerpb.Capabilities, error) {
+	caps := capabilities()
+	out := &workerpb.Capabilities{
+		CheckTypes:            caps.CheckTypes,
+		MaxSourcesSizeBytes:   caps.MaxSourcesSizeBytes,
+		MaxSourceFileNameSize: int32(caps.MaxSourceFileNameSize),
+	}
+	for _, buildEnv := range caps.BuildEnvs {
+		out.BuildEnvs = append(out.BuildEnvs, &workerpb.BuildEnv{Name: buildEnv.Name, Targets: buildEnv.Targets})
+	}
+	return out, nil
+}
+
+func (s *grpcServer) Execute(in *workerpb.ExecuteRequest, stream workerpb.Worker_ExecuteServer) error {
+	body := api.ExecuteRequest{
+		RequestID: in.RequestId,
+		BuildEnv:  in.BuildEnv,
+		Target:    in.Target,
+		Requester: in.Requester,
+		TestSuite: testSuiteFromProto(in.TestSuite),
+		Timestamp: in.Timestamp,
+		Signature: in.Signature,
+	}
+	for _, sf := range in.SourceFiles {
+		body.SourceFiles = append(body.SourceFiles, api.SourceFile{Name: sf.Name, Text: string(sf.Text)})
+	}
+	err := verifyExecuteSignature(body)
+	if err != nil {
+		auditRejected(body.RequestID, body.Requester, body.BuildEnv, body.Target, fmt.Sprintf("Rejected request: %v", err))
+		return status.Errorf(codes.Unauthenticated, "rejected request: %v", err)
+	}
+	req := newLocalRequest(body, "grpc")
+	buildStages, stages, err := resolveLocalRequest(req)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// the request is stopped by Stop or when the client goes away
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	s.mu.Lock()
+	if _, ok := s.running[req.RequestID]; ok {
+		s.mu.Unlock()
+		return status.Errorf(codes.AlreadyExists, "request %s is already running", req.RequestID)
+	}
+	s.running[req.RequestID] = cancel
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.running, req.RequestID)
+		s.mu.Unlock()
+	}()
+
+	if p, ok := peer.FromContext(stream.Context()); ok {
+		log.Infof("gRPC request %s from %s", req.RequestID, p.Addr)
+	}
+	var sendErr error
+	err = executeLocal(ctx, req, buildStages, stages, func(msg interface{}) {
+		if sendErr != nil {
+			return
+		}
+		event := eventToProto(msg)
+		if event == nil {
+			return
+		}
+		event.RequestId = req.RequestID
+		sendErr = stream.Send(event)
+		if sendErr != nil {
+			log.Errorf("Failed to send gRPC event for request %s: %v", req.RequestID, sendErr)
+			cancel()
+		}
+	})
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return sendErr
+}
+
+func (s *grpcServer) Stop(ctx context.Context, in *workerpb.StopRequest) (*workerpb.StopResponse, error) {
+	s.mu.Lock()
+	cancel, ok := s.running[in.RequestId]
+	s.mu.Unlock()
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "request %s is not running", in.RequestId)
+	}
+	cancel()
+	return &workerpb.StopResponse{}, nil
+}
+
+func testSuiteFromProto(in *workerpb.TestSuite) *api.TestSuite {
+	if in == nil {
+		return nil
+	}
+	convert := func(testCases []*workerpb.TestCase) []api.TestCase {
+		out := make([]api.TestCase, 0, len(testCases))
+		for _, tc := range testCases {
+			testCase := api.TestCase{Description: tc.Description}
+			for _, check := range tc.Checks {
+				testCase.Checks = append(testCase.Checks, api.TestCheck{Type: check.Type, Arg: check.Arg})
+			}
+			out = append(out, testCase)
+		}
+		return out
+	}
+	return &api.TestSuite{InitTestCases: convert(in.InitTestCases), TestCases: convert(in.TestCases), RunAllTestCases: in.RunAllTestCases}
+}
+
+// eventToProto converts an outgoing api message, returns nil for unknown ones
+func eventToProto(msg interface{}) *workerpb.Event {
+	switch m := msg.(type) {
+	case api.Accepted:
+		accepted := &workerpb.Accepted{TestSuiteExpected: m.TestSuiteExpected}
+		for _, stage := range m.Stages {
+			accepted.Stages = append(accepted.Stages, &workerpb.AcceptedStage{
+				Name: stage.Name,
+				Limits: &workerpb.Limits{
+					AddressSpaceMb:  stage.Limits.AddressSpaceMb,
+					RunTimeSec:      stage.Limits.RunTimeSec,
+					FileDescriptors: stage.Limits.FileDescriptors,
+					FileWritesMb:    stage.Limits.FileWritesMb,
+					Threads:         stage.Limits.Threads,
+					OutputBytes:     stage.Limits.OutputBytes,
+				},
+			})
+		}
+		return &workerpb.Event{Event: &workerpb.Event_Accepted{Accepted: accepted}}
+	case api.StageEvent:
+		return &workerpb.Event{Event: &workerpb.Event_StageEvent{StageEvent: &workerpb.StageEvent{Event: m.Event, Stage: m.Stage, TestCase: m.TestCase}}}
+	case api.Output:
+		text, err := base64.StdEncoding.DecodeString(m.Text)
+		if err != nil {
+			log.Errorf("Failed to decode output of stage %s: %v", m.Stage, err)
+			return nil
+		}
+		return &workerpb.Event{Event: &workerpb.Event_Output{Output: &workerpb.Output{Text: text, Type: m.Type, Stage: m.Stage}}}
+	case api.OutputDropped:
+		return &workerpb.Event{Event: &workerpb.Event_OutputDropped{OutputDropped: &workerpb.OutputDropped{DroppedBytes: m.DroppedBytes, Stage: m.Stage}}}
+	case api.ExitCode:
+		return &workerpb.Event{Event: &workerpb.Event_ExitCode{ExitCode: &workerpb.ExitCode{ExitCode: int32(m.ExitCode), Stage: m.Stage}}}
+	case api.Duration:
+		return &workerpb.Event{Event: &workerpb.Event_Duration{Duration: &workerpb.Duration{DurationSec: m.DurationSec, Stage: m.Stage}}}
+	case api.ResourceUsage:
+		return &workerpb.Event{Event: &workerpb.Event_ResourceUsage{ResourceUsage: &workerpb.ResourceUsage{MaxRssKb: m.MaxRSSKb, CpuTimeSec: m.CPUTimeSec, Stage: m.Stage}}}
+	case api.TestResult:
+		return &workerpb.Event{Event: &workerpb.Event_TestResult{TestResult: &workerpb.TestResult{TestCase: m.TestCase, Result: m.Result, Stage: m.Stage}}}
+	case api.Error:
+		return &workerpb.Event{Event: &workerpb.Event_Error{Error: &workerpb.Error{Description: m.Desc, Stage: m.Stage}}}
+	case api.Finish:
+		return &workerpb.Event{Event: &workerpb.Event_Finish{Finish: &workerpb.Finish{}}}
+	}
+	return nil
+}
+
+// serveGRPC serves the gRPC API on addr until it fails, over TLS if tlsConfig isn't nil,
+// clients must send the token if it isn't empty
+func serveGRPC(addr string, tlsConfig *tls.Config, token string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	options := grpcTokenOptions(token)
+	if tlsConfig != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	server := grpc.NewServer(options...)
+	workerpb.RegisterWorkerServer(server, newGRPCServer())
+	go func() {
+		// new calls are refused, running ones finish
+		<-drain.started
+		server.GracefulStop()
+	}()
+	log.Infof("Serving gRPC on %s", addr)
+	return server.Serve(listener)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/base64"
 	"encoding/json"
@@ -8,17 +9,24 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 	"unicode"
 
 	"github.com/gorilla/websocket"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/practicode-org/worker/src/api"
 	"github.com/practicode-org/worker/src/config"
@@ -26,15 +34,46 @@ import (
 	"github.com/practicode-org/worker/src/tests"
 )
 
-var wsUpgrader = websocket.Upgrader{}
-
 type CloseEvent struct{}
 
-func receiveTestSuite(recvMessages <-chan []byte) (api.TestSuite, error) {
-	bytes := <-recvMessages
+var errRequestStopped = errors.New("the request was stopped")
+
+// receiveMessage waits for the next message of the request, errRequestStopped if the client sends stop instead
+func receiveMessage(ctx context.Context, recvMessages <-chan api.Envelope) (api.Envelope, error) {
+	select {
+	case env := <-recvMessages:
+		if env.Type == api.TypeStop {
+			return api.Envelope{}, errRequestStopped
+		}
+		return env, nil
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return api.Envelope{}, fmt.Errorf("nothing was received for %v", *receiveTimeoutFlag)
+		}
+		return api.Envelope{}, errRequestStopped
+	}
+}
+
+// receiveOutcome returns the outcome of a request which failed to receive its inputs
+func receiveOutcome(ctx context.Context, err error) string {
+	if errors.Is(err, errRequestStopped) {
+		return outcomeStopped
+	}
+	return outcomeOf(ctx, outcomeError)
+}
+
+func receiveTestSuite(ctx context.Context, recvMessages <-chan api.Envelope) (api.TestSuite, error) {
+	env, err := receiveMessage(ctx, recvMessages)
+	if err != nil {
+		return api.TestSuite{}, err
+	}
+	if env.Type != api.TypeTestSuite {
+		return api.TestSuite{}, fmt.Errorf("expected a %s message, got %q", api.TypeTestSuite, env.Type)
+	}
+	bytes := env.Payload
 
 	msg := api.TestSuite{}
-	err := json.Unmarshal(bytes, &msg)
+	err = json.Unmarshal(bytes, &msg)
 	if err != nil {
 		return msg, fmt.Errorf("failed to unmarshal test cases message: %w, text: %s", err, trimLongString(string(bytes), 64))
 	}
@@ -44,12 +83,25 @@ func receiveTestSuite(recvMessages <-chan []byte) (api.TestSuite, error) {
 	return msg, nil
 }
 
+const maxSourceFileNameSize = 64
+
+// how long to wait for the rest of the output after the process has exited
+const outputDrainTimeout = time.Second
+
+// receiveSourceCode writes the received files to sourcesDir
 // returns []fileNames, []sourceTexts, error
-func receiveSourceCode(recvMessages <-chan []byte) ([]string, []string, error) {
-	bytes := <-recvMessages
+func receiveSourceCode(ctx context.Context, recvMessages <-chan api.Envelope, sourcesDir string) ([]string, []string, error) {
+	env, err := receiveMessage(ctx, recvMessages)
+	if err != nil {
+		return nil, nil, err
+	}
+	if env.Type != api.TypeSourceFiles {
+		return nil, nil, fmt.Errorf("expected a %s message, got %q", api.TypeSourceFiles, env.Type)
+	}
+	bytes := env.Payload
 
 	msg := api.ClientMessage{}
-	err := json.Unmarshal(bytes, &msg)
+	err = json.Unmarshal(bytes, &msg)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to unmarshal source code message: %w, text: %s", err, trimLongString(string(bytes), 64))
 	}
@@ -62,7 +114,7 @@ func receiveSourceCode(recvMessages <-chan []byte) ([]string, []string, error) {
 
 	for i, sf := range msg.SourceFiles {
 		// check file name
-		if len(sf.Name) == 0 || len(sf.Name) > 64 {
+		if len(sf.Name) == 0 || len(sf.Name) > maxSourceFileNameSize {
 			return nil, nil, fmt.Errorf("source file name is too long")
 		}
 		if sf.Name[0] == '.' || sf.Name[len(sf.Name)-1] == '.' {
@@ -103,7 +155,7 @@ func receiveSourceCode(recvMessages <-chan []byte) ([]string, []string, error) {
 	fileNames := []string{}
 
 	for _, sf := range msg.SourceFiles {
-		filePath := filepath.Join(config.Cfg.SourcesDir, sf.Name)
+		filePath := filepath.Join(sourcesDir, sf.Name)
 
 		err := ioutil.WriteFile(filePath, []byte(sf.Text), 0660) // rw-/rw-/---
 		if err != nil {
@@ -120,7 +172,13 @@ func KillProcess(proc *os.Process) error {
 	return proc.Signal(os.Kill)
 }
 
-func wrapToJail(command string, env []string, mounts []string, limits *rules.Limits, sourceFiles []string) (string, []string) {
+// jailPaths are paths of the request which are substituted into stage commands, env and mounts
+type jailPaths struct {
+	sourceFiles []string // {sources}
+	outDir      string   // {out}, a directory for build results which only this request uses
+}
+
+func wrapToJail(command string, env []string, mounts []string, limits *rules.Limits, paths jailPaths) (string, []string) {
 	envStr := ""
 	for _, envVar := range env {
 		envStr += " --env=" + envVar
@@ -131,7 +189,8 @@ func wrapToJail(command string, env []string, mounts []string, limits *rules.Lim
 		mountStr += " --bindmount=" + mountDir
 	}
 
-	nsjailCmd := fmt.Sprintf("/usr/bin/nsjail --really_quiet --nice_level=0%s%s --time_limit=%.1f --rlimit_as=%d --rlimit_core=0 --rlimit_fsize=%d --rlimit_nofile=%d --rlimit_nproc=%d --chroot / -- ",
+	nsjailCmd := fmt.Sprintf("%s --really_quiet --nice_level=0%s%s --time_limit=%.1f --rlimit_as=%d --rlimit_core=0 --rlimit_fsize=%d --rlimit_nofile=%d --rlimit_nproc=%d --chroot / -- ",
+		config.Cfg.NsjailPath,
 		mountStr,
 		envStr,
 		limits.RunTime,
@@ -141,16 +200,27 @@ func wrapToJail(command string, env []string, mounts []string, limits *rules.Lim
 		limits.Threads,
 	)
 	nsjailCmd += command
-	// replace {sources} with source files paths
-	sourceFilesStr := strings.Join(sourceFiles, " ")
+	// replace {sources} with source files paths and {out} with the request's output directory
+	sourceFilesStr := strings.Join(paths.sourceFiles, " ")
 	nsjailCmd = strings.ReplaceAll(nsjailCmd, "{sources}", sourceFilesStr)
+	nsjailCmd = strings.ReplaceAll(nsjailCmd, "{out}", paths.outDir)
 	return nsjailCmd, strings.Split(nsjailCmd, " ")
 }
 
-func runCommand(sendMessages chan<- interface{}, clientCommands <-chan []byte, stage *rules.Stage, testCase *api.TestCase, testCaseIdx int, sourceFiles []string, requestID string) bool {
+func runCommand(ctx context.Context, sendMessages chan<- interface{}, stage *rules.Stage, testCase *api.TestCase, testCaseIdx int, paths jailPaths, requestID string, buildEnv string, record *auditRecord) bool {
 	startTime := time.Now()
 
-	jailedCommand, jailedArgs := wrapToJail(stage.Command, stage.Env, stage.Mounts, stage.Limits, sourceFiles)
+	ctx, span := tracer.Start(ctx, "stage "+stage.Name, trace.WithAttributes(limitsAttributes(stage.Limits)...))
+	span.SetAttributes(attribute.String("stage.name", stage.Name))
+	if testCase != nil {
+		span.SetAttributes(attribute.Int("stage.test_case", testCaseIdx))
+	}
+	defer span.End()
+
+	jailedCommand, jailedArgs := wrapToJail(stage.Command, stage.Env, stage.Mounts, stage.Limits, paths)
+	stageAudit := newAuditStage(stage, testCaseIdx, jailedCommand)
+	stageAudit.ExitReason = "error"
+	defer func() { record.addStage(stageAudit) }()
 
 	if testCase == nil {
 		log.Infof("Running stage '%s' command: %s", stage.Name, jailedCommand)
@@ -162,35 +232,47 @@ func runCommand(sendMessages chan<- interface{}, clientCommands <-chan []byte, s
 
 	stdoutPipe, err := cmd.StdoutPipe()
 	if err != nil {
+		record.addError(fmt.Sprintf("stage %s: failed to get program's stdout pipe: %v", stage.Name, err))
 		sendMessages <- api.Error{Desc: fmt.Sprintf("Failed to get program's stdout pipe: %v", err), Stage: stage.Name, RequestID: requestID}
+		span.SetStatus(codes.Error, err.Error())
 		return false
 	}
 	stderrPipe, err := cmd.StderrPipe()
 	if err != nil {
+		record.addError(fmt.Sprintf("stage %s: failed to get program's stderr pipe: %v", stage.Name, err))
 		sendMessages <- api.Error{Desc: fmt.Sprintf("Failed to get program's stderr pipe: %v", err), Stage: stage.Name, RequestID: requestID}
+		span.SetStatus(codes.Error, err.Error())
 		return false
 	}
 
 	var outputTransferred uint64
+	var outputExceeded int32
 
+	// output goes through the spool, so the program doesn't wait for the client to take it
+	spool := newOutputSpool(uint64(*outputBufferFlag))
+	var readers sync.WaitGroup
 	pipeTransfer := func(type_ string, readFrom io.Reader) {
+		defer readers.Done()
+		outputBytes := outputBytesTotal.WithLabelValues(buildEnv, stage.Name, type_)
 		for {
 			buf := make([]byte, 512)
 			n, err := readFrom.Read(buf)
-			if err != nil && err != io.EOF {
+			if err != nil && err != io.EOF && !errors.Is(err, os.ErrClosed) {
+				record.addError(fmt.Sprintf("stage %s: error while reading %s: %v", stage.Name, type_, err))
 				sendMessages <- api.Error{Desc: fmt.Sprintf("Error while reading stdout: %v", err), Stage: stage.Name, RequestID: requestID}
 				break
 			}
-			if n == 0 && err == io.EOF {
+			if n == 0 && err != nil {
 				break
 			}
 
-			encodedStr := base64.StdEncoding.EncodeToString(buf[:n])
-			sendMessages <- api.Output{Text: encodedStr, Type: type_, Stage: stage.Name, RequestID: requestID}
+			spool.write(type_, buf[:n])
+			outputBytes.Add(float64(n))
 
 			// check limits
 			transferredNew := atomic.AddUint64(&outputTransferred, uint64(n))
 			if transferredNew >= stage.Limits.Output {
+				atomic.StoreInt32(&outputExceeded, 1)
 				err := cmd.Process.Kill() // doesn't kill child processes
 				if err != nil {
 					log.Errorf("Couldn't kill proc id: %d due to excessive output: %v", cmd.Process.Pid, err)
@@ -202,14 +284,52 @@ func runCommand(sendMessages chan<- interface{}, clientCommands <-chan []byte, s
 		}
 	}
 
-	go pipeTransfer("stdout", stdoutPipe)
-	go pipeTransfer("stderr", stderrPipe)
-
 	err = cmd.Start()
 	if err != nil {
+		record.addError(fmt.Sprintf("stage %s: failed to run program process: %v", stage.Name, err))
 		sendMessages <- api.Error{Desc: fmt.Sprintf("Failed to run program process: %v", err), Stage: stage.Name, RequestID: requestID}
+		span.SetStatus(codes.Error, err.Error())
 		return false
 	}
+	activeJails.Inc()
+
+	readers.Add(2)
+	go pipeTransfer("stdout", stdoutPipe)
+	go pipeTransfer("stderr", stderrPipe)
+	forwarded := make(chan uint64, 1)
+	go func() {
+		forwarded <- spool.forward(func(type_ string, data []byte) {
+			sendMessages <- api.Output{Text: base64.StdEncoding.EncodeToString(data), Type: type_, Stage: stage.Name, RequestID: requestID}
+		})
+	}()
+
+	// finishOutput sends the rest of the output once the process has exited
+	finishOutput := func() {
+		_, flushSpan := tracer.Start(ctx, "flush_output")
+		defer flushSpan.End()
+		readersDone := make(chan struct{})
+		go func() {
+			readers.Wait()
+			close(readersDone)
+		}()
+		select {
+		case <-readersDone:
+		case <-time.After(outputDrainTimeout):
+			// some child process which outlived the program still holds the pipes
+			log.Warningf("Output pipes of stage %s are still open after the process exited, closing them", stage.Name)
+			stdoutPipe.Close()
+			stderrPipe.Close()
+			<-readersDone
+		}
+		spool.close()
+		dropped := <-forwarded
+		if dropped != 0 {
+			log.Warningf("Dropped %d bytes of output of stage %s, the client is too slow", dropped, stage.Name)
+			outputDroppedBytesTotal.Add(float64(dropped))
+			flushSpan.SetAttributes(attribute.Int64("output.dropped_bytes", int64(dropped)))
+			sendMessages <- api.OutputDropped{DroppedBytes: dropped, Stage: stage.Name, RequestID: requestID}
+		}
+	}
 
 	evt := api.StageEvent{Event: "started", Stage: stage.Name, RequestID: requestID}
 	if testCase != nil {
@@ -218,54 +338,65 @@ func runCommand(sendMessages chan<- interface{}, clientCommands <-chan []byte, s
 	sendMessages <- evt
 	log.Debugf("Started process pid %d", cmd.Process.Pid)
 
-	// listen to commands from the client
+	// kill the process if the request gets stopped
 	var killed int32
 	quitCmdLoop := make(chan struct{})
 	go func() {
 		proc := cmd.Process
-		quit := false
-		for !quit {
+		select {
+		case <-ctx.Done():
 			select {
-			case bytes, ok := <-clientCommands:
-				if !ok {
-					break
-				}
-				msg := api.ClientMessage{}
-				err := json.Unmarshal(bytes, &msg)
-				if err != nil {
-					log.Errorf("Failed to unmarshal: %v, message: %s", err, trimLongString(string(bytes), 64))
-					continue
-				}
-				if msg.Command == "stop" {
-					err := KillProcess(proc)
-					if err != nil {
-						log.Errorf("Failed to kill process pid %d: %v", proc.Pid, err)
-					}
-					atomic.StoreInt32(&killed, 1)
-					break
-				} else {
-					log.Errorf("Received unknown client message (expected a stop command only), message: %s", trimLongString(string(bytes), 64))
-				}
 			case <-quitCmdLoop:
-				quit = true
-				break
+				return // the process has already finished
+			default:
+			}
+			err := KillProcess(proc)
+			if err != nil {
+				log.Errorf("Failed to kill process pid %d: %v", proc.Pid, err)
 			}
+			atomic.StoreInt32(&killed, 1)
+		case <-quitCmdLoop:
 		}
 	}()
 	defer func() { close(quitCmdLoop) }()
 
 	//
 	procState, err := cmd.Process.Wait()
+	// the run time is taken before sending the rest of the output, so a slow client doesn't add to it
+	duration := time.Since(startTime)
+	activeJails.Dec()
+	finishOutput()
 	if err != nil {
+		record.addError(fmt.Sprintf("stage %s: failed to wait program process: %v", stage.Name, err))
 		sendMessages <- api.Error{Desc: fmt.Sprintf("Failed to wait program process: %v", err), Stage: stage.Name, RequestID: requestID}
+		span.SetStatus(codes.Error, err.Error())
 		return false
 	}
 
 	exitCode := procState.ExitCode()
-	duration := time.Since(startTime)
+	limit := observeStageRun(buildEnv, stage, exitCode, duration, atomic.LoadInt32(&outputExceeded) != 0, atomic.LoadInt32(&killed) != 0)
+	span.SetAttributes(
+		attribute.Int("stage.exit_code", exitCode),
+		attribute.Int64("stage.output_bytes", int64(atomic.LoadUint64(&outputTransferred))),
+		attribute.Bool("stage.stopped", atomic.LoadInt32(&killed) != 0),
+	)
+	if limit != "" {
+		span.SetAttributes(attribute.String("stage.exceeded_limit", limit))
+	}
+	stageAudit.ExitCode = exitCode
+	stageAudit.DurationSec = duration.Seconds()
+	stageAudit.OutputBytes = atomic.LoadUint64(&outputTransferred)
+	switch {
+	case limit != "":
+		stageAudit.ExitReason = "limit:" + limit
+	case atomic.LoadInt32(&killed) != 0:
+		stageAudit.ExitReason = "stopped"
+	default:
+		stageAudit.ExitReason = "exited"
+	}
 
 	if atomic.LoadInt32(&killed) != 0 {
-		log.Infof("Process killed by client request, exit code: %d, stage duration: %.2f sec, output: %d bytes", exitCode, duration.Seconds(), outputTransferred)
+		log.Infof("Process killed as the request was stopped, exit code: %d, stage duration: %.2f sec, output: %d bytes", exitCode, duration.Seconds(), outputTransferred)
 	} else {
 		log.Infof("Process exit code: %d, stage duration: %.2f sec, output: %d bytes", exitCode, duration.Seconds(), outputTransferred)
 	}
@@ -278,6 +409,7 @@ func runCommand(sendMessages chan<- interface{}, clientCommands <-chan []byte, s
 			var err error
 			passedTests, err = tests.CheckExitCode(checkDesc, exitCode)
 			if err != nil {
+				record.addError(fmt.Sprintf("stage %s: test case %d: %v", stage.Name, testCaseIdx, err))
 				sendMessages <- api.Error{Desc: err.Error(), Stage: stage.Name, RequestID: requestID}
 				passedTests = false
 			}
@@ -294,80 +426,308 @@ func runCommand(sendMessages chan<- interface{}, clientCommands <-chan []byte, s
 
 	sendMessages <- api.ExitCode{ExitCode: exitCode, Stage: stage.Name, RequestID: requestID}
 	sendMessages <- api.Duration{DurationSec: duration.Seconds(), Stage: stage.Name, RequestID: requestID}
+	if rusage, ok := procState.SysUsage().(*syscall.Rusage); ok {
+		cpuTime := time.Duration(rusage.Utime.Nano() + rusage.Stime.Nano())
+		stageAudit.MaxRSSKb = rusage.Maxrss
+		stageAudit.CPUTimeSec = cpuTime.Seconds()
+		sendMessages <- api.ResourceUsage{MaxRSSKb: rusage.Maxrss, CPUTimeSec: cpuTime.Seconds(), Stage: stage.Name, RequestID: requestID}
+	}
 	sendMessages <- api.StageEvent{Event: "completed", Stage: stage.Name, RequestID: requestID}
 
 	if testCase != nil {
 		return passedTests
 	}
 
-	return exitCode == 0
+	return stage.ExitCodeAllowed(exitCode)
 }
 
-/*func handleRun(w http.ResponseWriter, r *http.Request, buildEnv string) {
-	log.Debugf("Got a request")
+// checkOrigin allows connections from clients without Origin header (not browsers) and from the allowed origins,
+// "*" allows any origin. If no origins are allowed explicitly, only same host origins are.
+func checkOrigin(allowedOrigins []string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		if len(allowedOrigins) == 0 {
+			u, err := url.Parse(origin)
+			return err == nil && strings.EqualFold(u.Host, r.Host)
+		}
+		for _, allowed := range allowedOrigins {
+			if allowed == "*" || strings.EqualFold(allowed, origin) {
+				return true
+			}
+		}
+		log.Warningf("Rejected websocket connection from origin %s", origin)
+		return false
+	}
+}
 
-	query := r.URL.Query()
+// handleRun serves a client connected directly to the worker (listen mode) with the same protocol as the backend uses,
+// optional build_env query parameter is used for requests which don't specify it
+func handleRun(w http.ResponseWriter, r *http.Request, allowedOrigins []string) {
+	log.Debugf("Got a connection from %s", r.RemoteAddr)
 
-	requestBuildEnv := query.Get("build_env")
-	if requestBuildEnv == "" {
-		log.Errorf("Error: got a request without build_env")
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-	if buildEnv != requestBuildEnv {
-		log.Errorf("Error: got a request with build_env %s, but %s is loaded", buildEnv, requestBuildEnv)
-		w.WriteHeader(http.StatusBadRequest)
-		return
+	buildEnv := r.URL.Query().Get("build_env")
+	if buildEnv != "" {
+		if _, err := rules.BuildEnv(buildEnv); err != nil {
+			log.Errorf("Error: got a connection with build_env %s, but it's not loaded", buildEnv)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
 	}
 
-	wsUpgrader.CheckOrigin = func(r *http.Request) bool { return true }
-	c, err := wsUpgrader.Upgrade(w, r, nil)
+	wsUpgrader := websocket.Upgrader{CheckOrigin: checkOrigin(allowedOrigins)}
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Errorf("Failed to upgrade to Websocket: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	defer c.Close()
 
-	handleWsConnection(c, "no-request-id") // TODO: fix
-}*/
+	handleBackendConnection(conn, buildEnv, &backendSession{}) // Note: connection is closed inside
+}
+
+// listenForStop cancels the request once the client sends a stop command
+func listenForStop(ctx context.Context, cancel context.CancelFunc, clientCommands <-chan api.Envelope) {
+	for {
+		select {
+		case env, ok := <-clientCommands:
+			if !ok {
+				return
+			}
+			if env.Type == api.TypeStop {
+				cancel()
+				return
+			}
+			log.Errorf("Received unexpected client message %q (expected a stop message only), payload: %s", env.Type, trimLongString(string(env.Payload), 64))
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// runLayer runs independent stages in parallel, returns true if the pipeline has failed after the layer.
+// Once the pipeline has failed, only stages with AlwaysRun are run, the others are skipped.
+func runLayer(ctx context.Context, sendMessages chan<- interface{}, layer []*rules.Stage, failedBefore bool, paths jailPaths, requestID string, buildEnv string, record *auditRecord) bool {
+	var failed int32
+	if failedBefore {
+		failed = 1
+	}
+
+	var wg sync.WaitGroup
+	for _, stage := range layer {
+		if failedBefore && !stage.AlwaysRun {
+			sendMessages <- api.StageEvent{Event: "skipped", Stage: stage.Name, RequestID: requestID}
+			continue
+		}
+		wg.Add(1)
+		go func(stage *rules.Stage) {
+			defer wg.Done()
+			success := runCommand(ctx, sendMessages, stage, nil, -1, paths, requestID, buildEnv, record)
+			if !success && !stage.ContinueOnFailure {
+				atomic.StoreInt32(&failed, 1)
+			}
+		}(stage)
+	}
+	wg.Wait()
+	return atomic.LoadInt32(&failed) != 0
+}
+
+// targetHasTests tells whether the target expects a test suite, its stage then runs once per test case
+func targetHasTests(target string) bool {
+	return strings.Contains(target, "tests")
+}
+
+// only one request runs at a time unless setRequestConcurrency allows more
+var requestSlots = make(chan struct{}, 1)
 
-func handleRequest(requestID string, target string, stages []*rules.Stage, recvMessages <-chan []byte, sendMessages chan<- interface{}) {
+// setRequestConcurrency allows n requests to run at the same time, which is safe only if stages of the rules
+// write only to {out}, every request has its own. Must be called before any request starts.
+func setRequestConcurrency(n int) {
+	requestSlots = make(chan struct{}, n)
+}
+
+func apiLimits(limits *rules.Limits) api.Limits {
+	return api.Limits{
+		AddressSpaceMb:  limits.AddressSpace,
+		RunTimeSec:      limits.RunTime,
+		FileDescriptors: limits.FileDescriptors,
+		FileWritesMb:    limits.FileWrites,
+		Threads:         limits.Threads,
+		OutputBytes:     limits.Output,
+	}
+}
+
+// acceptedMessage describes the stages which are going to run for the request
+func acceptedMessage(requestID string, target string, stages []*rules.Stage) api.Accepted {
+	msg := api.Accepted{Stages: []api.AcceptedStage{}, TestSuiteExpected: targetHasTests(target), RequestID: requestID}
+	for _, stage := range stages {
+		msg.Stages = append(msg.Stages, api.AcceptedStage{Name: stage.Name, Limits: apiLimits(stage.Limits)})
+	}
+	return msg
+}
+
+// handleRequest receives the test suite (if needed) and sources of the request and runs its stages,
+// cancelling ctx stops the request the same way a client's stop command does. requester is who submitted the request,
+// it's written to the audit log. If expectedHash isn't empty, received sources must match it, see sourcesHash.
+func handleRequest(ctx context.Context, requestID string, buildEnv string, target string, requester string, expectedHash string, stages []*rules.Stage, recvMessages <-chan api.Envelope, sendMessages chan<- interface{}) {
 	log.Debugf("handleRequest started with %d stages for request %s", len(stages), requestID)
 
+	record := newAuditRecord(requestID, requester, buildEnv, target)
+	if !drain.startRequest() {
+		requestsTotal.WithLabelValues(buildEnv, target, outcomeRejected).Inc()
+		record.addError("the worker is shutting down")
+		record.finish(outcomeRejected)
+		sendMessages <- api.Error{Desc: "The worker is shutting down and doesn't take new requests", Stage: "init", RequestID: requestID}
+		sendMessages <- api.Finish{Finish: true, RequestID: requestID}
+		return
+	}
+	defer drain.endRequest()
+
+	ctx, span := tracer.Start(ctx, "request", trace.WithAttributes(
+		attribute.String("request.id", requestID),
+		attribute.String("request.build_env", buildEnv),
+		attribute.String("request.target", target),
+	))
+	outcome := outcomeError
 	defer func() {
+		record.finish(outcome)
+		requestsTotal.WithLabelValues(buildEnv, target, outcome).Inc()
+		span.SetAttributes(attribute.String("request.outcome", outcome))
+		if outcome == outcomeError {
+			span.SetStatus(codes.Error, "the request couldn't run")
+		}
+		span.End()
 		sendMessages <- api.Finish{Finish: true, RequestID: requestID}
 	}()
 
+	// stop the request if it's still running when the drain deadline passes
+	drainCtx, stopDrain := context.WithCancelCause(ctx)
+	defer stopDrain(nil)
+	go func() {
+		select {
+		case <-drain.kill:
+			stopDrain(errDrainDeadline)
+		case <-drainCtx.Done():
+		}
+	}()
+	defer func() {
+		if context.Cause(drainCtx) == errDrainDeadline {
+			record.addError("the worker is shutting down, the request was stopped")
+			sendMessages <- api.Error{Desc: "The worker is shutting down, the request was stopped", RequestID: requestID}
+		}
+	}()
+	ctx = drainCtx
+
+	queuedAt := time.Now()
+	_, queueSpan := tracer.Start(ctx, "queue")
+	select {
+	case requestSlots <- struct{}{}:
+		queueSpan.End()
+		queueWaitSeconds.Observe(time.Since(queuedAt).Seconds())
+		record.QueueSec = time.Since(queuedAt).Seconds()
+	case <-ctx.Done():
+		queueSpan.End()
+		outcome = outcomeStopped
+		record.addError("the request was stopped before it started")
+		sendMessages <- api.Error{Desc: "Request was stopped before it started", Stage: "init", RequestID: requestID}
+		return
+	}
+	defer func() { <-requestSlots }()
+
+	// accepted means the request has started, it isn't queued anymore
+	sendMessages <- acceptedMessage(requestID, target, stages)
+
+	// a client which doesn't send the test suite and sources (ex: the backend is gone while resuming) mustn't hold the slot forever
+	inputCtx := ctx
+	if *receiveTimeoutFlag > 0 {
+		var cancelInput context.CancelFunc
+		inputCtx, cancelInput = context.WithTimeout(ctx, *receiveTimeoutFlag)
+		defer cancelInput()
+	}
+
 	// receive test cases (if needed)
-	hasTests := strings.Contains(target, "tests")
+	hasTests := targetHasTests(target)
 	var testSuite api.TestSuite
 	if hasTests {
 		var err error
-		testSuite, err = receiveTestSuite(recvMessages)
+		recvCtx, recvSpan := tracer.Start(inputCtx, "receive_test_suite")
+		testSuite, err = receiveTestSuite(recvCtx, recvMessages)
+		recvSpan.SetAttributes(attribute.Int("test_suite.test_cases", len(testSuite.TestCases)))
+		endSpan(recvSpan, err)
 		if err != nil {
+			outcome = receiveOutcome(ctx, err)
+			record.addError(fmt.Sprintf("failed to receive test cases: %v", err))
 			sendMessages <- api.Error{Desc: fmt.Sprintf("Failed to receive test cases: %v", err), Stage: "init", RequestID: requestID}
 			return
 		}
 		log.Debugf("Test suite received")
 	}
 
-	// receive source code
-	sourceFiles, sourceTexts, err := receiveSourceCode(recvMessages)
+	// receive source code, every request gets its own directory so parallel requests don't overwrite each other's files
+	sourcesDir, err := ioutil.TempDir(config.Cfg.SourcesDir, "request-")
+	if err != nil {
+		record.addError(fmt.Sprintf("failed to create sources directory: %v", err))
+		sendMessages <- api.Error{Desc: fmt.Sprintf("Failed to create sources directory: %v", err), Stage: "init", RequestID: requestID}
+		return
+	}
+	defer os.RemoveAll(sourcesDir)
+	err = os.Chmod(sourcesDir, 0770) // rwx/rwx/---
+	if err != nil {
+		record.addError(fmt.Sprintf("failed to set sources directory permissions: %v", err))
+		sendMessages <- api.Error{Desc: fmt.Sprintf("Failed to set sources directory permissions: %v", err), Stage: "init", RequestID: requestID}
+		return
+	}
+	// the same for build results, so parallel requests don't run each other's programs
+	outDir, err := ioutil.TempDir(config.Cfg.SourcesDir, "out-")
+	if err != nil {
+		record.addError(fmt.Sprintf("failed to create output directory: %v", err))
+		sendMessages <- api.Error{Desc: fmt.Sprintf("Failed to create output directory: %v", err), Stage: "init", RequestID: requestID}
+		return
+	}
+	defer os.RemoveAll(outDir)
+	err = os.Chmod(outDir, 0770) // rwx/rwx/---
+	if err != nil {
+		record.addError(fmt.Sprintf("failed to set output directory permissions: %v", err))
+		sendMessages <- api.Error{Desc: fmt.Sprintf("Failed to set output directory permissions: %v", err), Stage: "init", RequestID: requestID}
+		return
+	}
+	recvCtx, recvSpan := tracer.Start(inputCtx, "receive_source_code")
+	sourceFiles, sourceTexts, err := receiveSourceCode(recvCtx, recvMessages, sourcesDir)
+	recvSpan.SetAttributes(attribute.Int("sources.files", len(sourceFiles)))
+	endSpan(recvSpan, err)
 	if err != nil {
+		outcome = receiveOutcome(ctx, err)
+		record.addError(fmt.Sprintf("failed to receive source code: %v", err))
 		sendMessages <- api.Error{Desc: fmt.Sprintf("Failed to receive source code: %v", err), Stage: "init", RequestID: requestID}
 		return
 	}
+	record.setSources(sourceFiles, sourceTexts)
+	paths := jailPaths{sourceFiles: sourceFiles, outDir: outDir}
+	if expectedHash != "" {
+		names := make([]string, 0, len(sourceFiles))
+		for _, filePath := range sourceFiles {
+			names = append(names, filepath.Base(filePath))
+		}
+		if sourcesHash(names, sourceTexts) != strings.ToLower(expectedHash) {
+			outcome = outcomeError
+			record.addError("the source files don't match the signed sources_hash")
+			sendMessages <- api.Error{Desc: "The source files don't match the signed sources_hash", Stage: "init", RequestID: requestID}
+			return
+		}
+	}
 
 	// init tests
 	passInitTests := true
 	if hasTests {
+		_, initSpan := tracer.Start(ctx, "init_checks")
 		for i := 0; i < len(testSuite.InitTestCases); i++ {
 			testCase := testSuite.InitTestCases[i]
 			for j := 0; j < len(testCase.Checks); j++ {
 				var err error
 				passInitTests, err = tests.CheckSourceCode(testCase.Checks[j], sourceTexts)
 				if err != nil {
+					record.addError(fmt.Sprintf("init test case %d: %v", i, err))
 					sendMessages <- api.Error{Desc: err.Error(), Stage: "init", RequestID: requestID}
 					passInitTests = false
 				}
@@ -385,35 +745,58 @@ func handleRequest(requestID string, target string, stages []*rules.Stage, recvM
 		if passInitTests {
 			log.Debugf("Passed init test cases")
 		}
+		initSpan.SetAttributes(attribute.Bool("init_checks.passed", passInitTests))
+		initSpan.End()
 	}
 	sourceTexts = nil
 	if !passInitTests {
+		outcome = outcomeFailed
 		return
 	}
 
-	// run stages
-	for i := 0; i < len(stages); i++ {
-		if !hasTests {
-			success := runCommand(sendMessages, recvMessages, stages[i], nil, -1, sourceFiles, requestID)
-			if !success {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go listenForStop(ctx, cancel, recvMessages)
+
+	// run stages, independent stages of the same layer run in parallel
+	layers := rules.Layers(stages)
+	failed := false
+	for i, layer := range layers {
+		if ctx.Err() != nil {
+			break
+		}
+		if hasTests && i == len(layers)-1 {
+			// the target is the only stage in the last layer, it runs once per test case
+			stage := layer[0]
+			if failed && !stage.AlwaysRun {
+				sendMessages <- api.StageEvent{Event: "skipped", Stage: stage.Name, RequestID: requestID}
 				break
 			}
-		} else {
-			if i < len(stages)-1 {
-				success := runCommand(sendMessages, recvMessages, stages[i], nil, -1, sourceFiles, requestID)
-				if !success {
+			// test cases stop at the first failing one, unless the client wants a result for each of them
+			testsFailed := false
+			for j := 0; j < len(testSuite.TestCases); j++ {
+				if ctx.Err() != nil {
 					break
 				}
-			} else {
-				for j := 0; j < len(testSuite.TestCases); j++ {
-					success := runCommand(sendMessages, recvMessages, stages[i], &testSuite.TestCases[j], j, sourceFiles, requestID)
-					if !success {
+				success := runCommand(ctx, sendMessages, stage, &testSuite.TestCases[j], j, paths, requestID, buildEnv, record)
+				if !success {
+					testsFailed = true
+					if !testSuite.RunAllTestCases {
 						break
 					}
 				}
 			}
-
+			if testsFailed {
+				failed = true
+			}
+			break
 		}
+		failed = runLayer(ctx, sendMessages, layer, failed, paths, requestID, buildEnv, record)
+	}
+	if failed {
+		outcome = outcomeOf(ctx, outcomeFailed)
+	} else {
+		outcome = outcomeOf(ctx, outcomeSuccess)
 	}
 	// finish message will be sent in a deferred call
 }
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/practicode-org/worker/src/api"
+	"github.com/practicode-org/worker/src/rules"
+)
+
+func TestReceiveMessageTimeout(t *testing.T) {
+	recvMessages := make(chan api.Envelope)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	_, err := receiveTestSuite(ctx, recvMessages)
+	if err == nil || !strings.Contains(err.Error(), "nothing was received") {
+		t.Errorf("expected a timeout error, got %v", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, _, err = receiveSourceCode(ctx, recvMessages, t.TempDir())
+	if err != errRequestStopped {
+		t.Errorf("expected the request to be stopped, got %v", err)
+	}
+}
+
+func TestStopWhileReceiving(t *testing.T) {
+	useTestWorker(t)
+	readRecords := useAuditLog(t)
+
+	conn := dialRun(t)
+	msgs := []struct {
+		type_ string
+		msg   api.ClientMessage
+	}{
+		{api.TypeNew, api.ClientMessage{RequestID: "stopped", BuildEnv: "sh", Target: "run_tests"}},
+		{api.TypeStop, api.ClientMessage{RequestID: "stopped"}},
+	}
+	for i, m := range msgs {
+		env, err := api.NewEnvelope(m.type_, uint64(i+2), m.msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.WriteJSON(env); err != nil {
+			t.Fatal(err)
+		}
+	}
+	readUntil(t, conn, api.TypeFinish)
+
+	records := readRecords()
+	if len(records) != 1 || records[0].Outcome != outcomeStopped {
+		t.Fatalf("got records %+v, want one stopped request", records)
+	}
+}
+
+func TestWrapToJailPaths(t *testing.T) {
+	limits := &rules.Limits{AddressSpace: 100, RunTime: 1, FileDescriptors: 10, FileWrites: 1, Threads: 10}
+	paths := jailPaths{sourceFiles: []string{"/s/a.cpp", "/s/b.cpp"}, outDir: "/s/out-1"}
+	command, args := wrapToJail("cc -o {out}/prog {sources}", []string{"CACHE={out}/cache"}, []string{"{out}"}, limits, paths)
+	for _, want := range []string{"--bindmount=/s/out-1 ", "--env=CACHE=/s/out-1/cache ", "-- cc -o /s/out-1/prog /s/a.cpp /s/b.cpp"} {
+		if !strings.Contains(command, want) {
+			t.Errorf("%q doesn't contain %q", command, want)
+		}
+	}
+	if args[len(args)-1] != "/s/b.cpp" {
+		t.Errorf("last argument is %q", args[len(args)-1])
+	}
+}
+
+func TestRunAllTestCases(t *testing.T) {
+	useTestWorker(t)
+
+	failing := api.TestCase{Description: "exit 1", Checks: []api.TestCheck{{Type: "exit_code", Arg: "1"}}}
+	passing := api.TestCase{Description: "exit 0", Checks: []api.TestCheck{{Type: "exit_code", Arg: "0"}}}
+	for _, runAll := range []bool{false, true} {
+		suite := &api.TestSuite{TestCases: []api.TestCase{failing, passing, failing}, RunAllTestCases: runAll}
+		req := localRequest{
+			RequestID:   "tests",
+			BuildEnv:    "sh",
+			Target:      "run_tests",
+			TestSuite:   suite,
+			SourceFiles: []api.SourceFile{{Name: "main.sh", Text: "exit 0"}},
+		}
+		buildStages, stages, err := resolveLocalRequest(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		results := 0
+		err = executeLocal(context.Background(), req, buildStages, stages, func(msg interface{}) {
+			if _, ok := msg.(api.TestResult); ok {
+				results++
+			}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the first failing test case stops the rest by default
+		want := 1
+		if runAll {
+			want = 3
+		}
+		if results != want {
+			t.Errorf("run_all_test_cases %v: got %d test results, want %d", runAll, results, want)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/practicode-org/worker/src/config"
+	"github.com/practicode-org/worker/src/rules"
+)
+
+// the sandbox check spawns a jail, its result is reused for that long so frequent probes don't do it every time
+const sandboxCheckInterval = time.Second * 30
+
+const sandboxCheckTimeout = time.Second * 10
+
+// 1 while connected to the backend, used by the readiness check in backend mode
+var backendConnected int32
+
+type checkResult struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type healthResponse struct {
+	Status string        `json:"status"` // "ok" or "fail"
+	Checks []checkResult `json:"checks"`
+}
+
+type healthCheck struct {
+	name string
+	run  func() (string, error) // returns details of a passed check
+}
+
+func checkNsjail() (string, error) {
+	stat, err := os.Stat(config.Cfg.NsjailPath)
+	if err != nil {
+		return "", err
+	}
+	if !stat.Mode().IsRegular() || stat.Mode()&0111 == 0 {
+		return "", fmt.Errorf("%s isn't an executable file, mode %v", config.Cfg.NsjailPath, stat.Mode())
+	}
+	return config.Cfg.NsjailPath, nil
+}
+
+var sandboxCheck struct {
+	mu      sync.Mutex
+	checked time.Time
+	detail  string
+	err     error
+}
+
+// checkSandbox runs a trivial command in a jail
+func checkSandbox() (string, error) {
+	sandboxCheck.mu.Lock()
+	defer sandboxCheck.mu.Unlock()
+	if time.Since(sandboxCheck.checked) < sandboxCheckInterval {
+		return sandboxCheck.detail, sandboxCheck.err
+	}
+
+	limits := &rules.Limits{AddressSpace: 64, RunTime: 5, FileDescriptors: 16, FileWrites: 1, Threads: 4}
+	_, args := wrapToJail("/bin/true", nil, nil, limits, jailPaths{})
+	ctx, cancel := context.WithTimeout(context.Background(), sandboxCheckTimeout)
+	defer cancel()
+	startTime := time.Now()
+	output, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		err = fmt.Errorf("jailed /bin/true failed: %v, output: %s", err, trimLongString(string(output), 256))
+		log.Errorf("Sandbox check failed: %v", err)
+	}
+
+	sandboxCheck.checked = time.Now()
+	sandboxCheck.detail = fmt.Sprintf("jailed /bin/true took %.2f sec", time.Since(startTime).Seconds())
+	sandboxCheck.err = err
+	return sandboxCheck.detail, sandboxCheck.err
+}
+
+func checkRules() (string, error) {
+	names := rules.BuildEnvNames()
+	if len(names) == 0 {
+		return "", errors.New("no build envs loaded")
+	}
+	return fmt.Sprintf("%d build envs loaded", len(names)), nil
+}
+
+// checkSourcesDir checks that SourcesDir is writable and has enough free space
+func checkSourcesDir() (string, error) {
+	file, err := ioutil.TempFile(config.Cfg.SourcesDir, "health-")
+	if err != nil {
+		return "", fmt.Errorf("SourcesDir isn't writable: %w", err)
+	}
+	file.Close()
+	os.Remove(file.Name())
+
+	var stat syscall.Statfs_t
+	err = syscall.Statfs(config.Cfg.SourcesDir, &stat)
+	if err != nil {
+		return "", fmt.Errorf("failed to get free space of SourcesDir: %w", err)
+	}
+	freeMb := stat.Bavail * uint64(stat.Bsize) / 1024 / 1024
+	if freeMb < uint64(*minFreeDiskMbFlag) {
+		return "", fmt.Errorf("%d Mb free in %s, need at least %d Mb", freeMb, config.Cfg.SourcesDir, *minFreeDiskMbFlag)
+	}
+	return fmt.Sprintf("%d Mb free in %s", freeMb, config.Cfg.SourcesDir), nil
+}
+
+// checkLoad fails when every request slot is taken, so new requests would have to wait
+func checkLoad() (string, error) {
+	running, capacity := drain.requestCount(), cap(requestSlots)
+	if running >= capacity {
+		return "", fmt.Errorf("%d requests, capacity %d", running, capacity)
+	}
+	return fmt.Sprintf("%d requests, capacity %d", running, capacity), nil
+}
+
+func checkDraining() (string, error) {
+	if drain.isDraining() {
+		return "", errors.New("the worker is shutting down")
+	}
+	return "", nil
+}
+
+func checkBackend() (string, error) {
+	if atomic.LoadInt32(&backendConnected) == 0 {
+		return "", fmt.Errorf("not connected to the backend %s", *backendAddrFlag)
+	}
+	return "connected to " + *backendAddrFlag, nil
+}
+
+// liveness checks fail only on problems of the worker itself, which restarting it may fix
+var livenessChecks = []healthCheck{
+	{"nsjail", checkNsjail},
+	{"rules", checkRules},
+}
+
+// readiness checks additionally fail if the worker can't take a request right now,
+// including problems of the host, like a broken sandbox or a full disk, which a restart doesn't fix
+func readinessChecks() []healthCheck {
+	checks := append([]healthCheck{}, livenessChecks...)
+	checks = append(checks, healthCheck{"sandbox", checkSandbox}, healthCheck{"sources_dir", checkSourcesDir})
+	checks = append(checks, healthCheck{"load", checkLoad}, healthCheck{"draining", checkDraining})
+	if *backendAddrFlag != "" {
+		checks = append(checks, healthCheck{"backend", checkBackend})
+	}
+	return checks
+}
+
+// serveChecks runs the checks and answers 200 if all of them pass, 503 otherwise, with the results as JSON
+func serveChecks(w http.ResponseWriter, checks []healthCheck) {
+	response := healthResponse{Status: "ok", Checks: []checkResult{}}
+	for _, check := range checks {
+		detail, err := check.run()
+		result := checkResult{Name: check.name, OK: err == nil, Detail: detail}
+		if err != nil {
+			result.Detail = err.Error()
+			response.Status = "fail"
+		}
+		response.Checks = append(response.Checks, result)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if response.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	serveChecks(w, livenessChecks)
+}
+
+func handleReady(w http.ResponseWriter, r *http.Request) {
+	serveChecks(w, readinessChecks())
+}
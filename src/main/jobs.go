@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/practicode-org/worker/src/api"
+)
+
+// a job keeps at most that many output events, the rest are only counted
+const maxJobEvents = 10000
+
+var errTooManyJobs = errors.New("too many jobs, try again later")
+
+type job struct {
+	mu            sync.Mutex
+	info          api.Job
+	events        []api.Envelope
+	droppedEvents int
+	webhookURL    string
+	cancel        context.CancelFunc
+}
+
+// jobState is what gets persisted for a job
+type jobState struct {
+	Job           api.Job        `json:"job"`
+	Events        []api.Envelope `json:"events"`
+	DroppedEvents int            `json:"dropped_events,omitempty"`
+	WebhookURL    string         `json:"webhook_url,omitempty"`
+}
+
+// jobStore keeps jobs in memory and, if dir isn't empty, also on disk, so finished jobs survive restarts
+type jobStore struct {
+	mu        sync.Mutex
+	jobs      map[string]*job
+	dir       string
+	ttl       time.Duration // finished jobs older than that are forgotten
+	maxQueued int           // max unfinished jobs
+	maxJobs   int           // max jobs kept, the oldest finished ones are forgotten first
+}
+
+var jobs *jobStore
+
+func newJobStore(dir string, ttl time.Duration, maxQueued int, maxJobs int) (*jobStore, error) {
+	store := &jobStore{jobs: make(map[string]*job), dir: dir, ttl: ttl, maxQueued: maxQueued, maxJobs: maxJobs}
+	if dir == "" {
+		return store, nil
+	}
+
+	filePaths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list jobs in %s: %w", dir, err)
+	}
+	for _, filePath := range filePaths {
+		bytes, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read job: %w", err)
+		}
+		state := jobState{}
+		err = json.Unmarshal(bytes, &state)
+		if err != nil {
+			log.Errorf("Failed to unmarshal job %s, skip it: %v", filePath, err)
+			continue
+		}
+		j := &job{info: state.Job, events: state.Events, droppedEvents: state.DroppedEvents, webhookURL: state.WebhookURL}
+		if j.info.FinishedAt == nil {
+			// the worker was stopped while the job was queued or running
+			now := time.Now()
+			j.info.Status = "failed"
+			j.info.Error = "the worker was restarted before the job finished"
+			j.info.FinishedAt = &now
+			store.save(j)
+		}
+		store.jobs[j.info.ID] = j
+	}
+	log.Infof("Loaded %d jobs from %s", len(store.jobs), dir)
+	return store, nil
+}
+
+// save writes the job to disk, must be called with j.mu locked
+func (s *jobStore) save(j *job) {
+	if s.dir == "" {
+		return
+	}
+	bytes, err := json.Marshal(jobState{Job: j.info, Events: j.events, DroppedEvents: j.droppedEvents, WebhookURL: j.webhookURL})
+	if err != nil {
+		log.Errorf("Failed to marshal job %s: %v", j.info.ID, err)
+		return
+	}
+	filePath := filepath.Join(s.dir, j.info.ID+".json")
+	err = ioutil.WriteFile(filePath+".tmp", bytes, 0600)
+	if err == nil {
+		err = os.Rename(filePath+".tmp", filePath)
+	}
+	if err != nil {
+		log.Errorf("Failed to save job %s: %v", j.info.ID, err)
+	}
+}
+
+func (s *jobStore) get(id string) (*job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	return j, ok
+}
+
+// forget removes the job, must be called with s.mu locked
+func (s *jobStore) forget(id string) {
+	delete(s.jobs, id)
+	if s.dir != "" {
+		os.Remove(filepath.Join(s.dir, id+".json"))
+	}
+}
+
+// makeRoom forgets finished jobs older than ttl, and the oldest finished ones if there are still maxJobs or more.
+// Returns errTooManyJobs if a new job can't be added. Must be called with s.mu locked.
+func (s *jobStore) makeRoom() error {
+	unfinished := 0
+	var finished []*job
+	for id, j := range s.jobs {
+		j.mu.Lock()
+		finishedAt := j.info.FinishedAt
+		j.mu.Unlock()
+		if finishedAt == nil {
+			unfinished++
+		} else if s.ttl != 0 && time.Since(*finishedAt) > s.ttl {
+			s.forget(id)
+		} else {
+			finished = append(finished, j)
+		}
+	}
+	if unfinished >= s.maxQueued {
+		return errTooManyJobs
+	}
+
+	// finished jobs don't change anymore, so FinishedAt can be read without locking
+	sort.Slice(finished, func(a, b int) bool {
+		return finished[a].info.FinishedAt.Before(*finished[b].info.FinishedAt)
+	})
+	for i := 0; len(s.jobs) >= s.maxJobs && i < len(finished); i++ {
+		s.forget(finished[i].info.ID)
+	}
+	if len(s.jobs) >= s.maxJobs {
+		return errTooManyJobs
+	}
+	return nil
+}
+
+func newJobID() string {
+	bytes := make([]byte, 16)
+	_, err := rand.Read(bytes)
+	if err != nil {
+		panic(fmt.Sprintf("failed to generate job id: %v", err))
+	}
+	return hex.EncodeToString(bytes)
+}
+
+// submit checks the request and queues it, the job runs once the worker is free
+func (s *jobStore) submit(body api.JobRequest) (api.Job, error) {
+	id := newJobID()
+	if body.RequestID == "" {
+		body.RequestID = id
+	}
+	req := newLocalRequest(body.ExecuteRequest, "job")
+	buildStages, stages, err := resolveLocalRequest(req)
+	if err != nil {
+		return api.Job{}, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &job{
+		info:       api.Job{ID: id, Status: "queued", CreatedAt: time.Now()},
+		webhookURL: body.WebhookURL,
+		cancel:     cancel,
+	}
+	s.mu.Lock()
+	err = s.makeRoom()
+	if err != nil {
+		s.mu.Unlock()
+		cancel()
+		return api.Job{}, err
+	}
+	s.jobs[id] = j
+	s.mu.Unlock()
+
+	j.mu.Lock()
+	s.save(j)
+	info := j.info
+	j.mu.Unlock()
+
+	go func() {
+		defer cancel()
+		result := newRequestResult(req.RequestID, buildStages, req.Target)
+		err := executeLocal(ctx, req, buildStages, stages, func(msg interface{}) {
+			result.add(msg)
+			j.mu.Lock()
+			defer j.mu.Unlock()
+			if _, output := msg.(api.Output); output && len(j.events) >= maxJobEvents {
+				j.droppedEvents++
+				return
+			}
+			env, err := api.NewEnvelope(api.MessageType(msg), uint64(len(j.events)+1), msg)
+			if err != nil {
+				log.Errorf("Failed to marshal job event: %v", err)
+				return
+			}
+			// the request sends accepted once it leaves the queue
+			if _, accepted := msg.(api.Accepted); accepted && j.info.StartedAt == nil {
+				now := time.Now()
+				j.info.StartedAt = &now
+				if j.info.Status == "queued" {
+					j.info.Status = "running"
+				}
+			}
+			j.events = append(j.events, env)
+		})
+
+		j.mu.Lock()
+		now := time.Now()
+		j.info.FinishedAt = &now
+		if err != nil {
+			j.info.Status = "failed"
+			j.info.Error = err.Error()
+		} else {
+			response := result.Response()
+			j.info.Result = &response
+			if ctx.Err() != nil {
+				j.info.Status = "cancelled"
+			} else {
+				j.info.Status = "completed"
+			}
+		}
+		s.save(j)
+		info := j.info
+		j.mu.Unlock()
+
+		log.Infof("Job %s %s", info.ID, info.Status)
+		if j.webhookURL != "" {
+			deliverWebhook(j.webhookURL, info)
+		}
+	}()
+
+	return info, nil
+}
+
+// webhooks aren't redirected, a redirect could lead to a host which isn't allowed
+var webhookClient = &http.Client{
+	Timeout: time.Second * 10,
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		TLSHandshakeTimeout:   time.Second * 5,
+		ResponseHeaderTimeout: time.Second * 10,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       time.Minute,
+	},
+}
+
+// at most that many webhooks are delivered at the same time
+var webhookSlots = make(chan struct{}, 4)
+
+// checkWebhookURL allows only http(s) URLs of hosts listed in -webhook-allowed-hosts
+func checkWebhookURL(webhookURL string) error {
+	u, err := url.Parse(webhookURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("webhook_url must be an http(s) URL")
+	}
+	if *webhookAllowedHostsFlag == "" {
+		return fmt.Errorf("webhooks are disabled on this worker")
+	}
+	for _, host := range strings.Split(*webhookAllowedHostsFlag, ",") {
+		if strings.EqualFold(host, u.Hostname()) || strings.EqualFold(host, u.Host) {
+			return nil
+		}
+	}
+	return fmt.Errorf("webhook host %s is not allowed", u.Host)
+}
+
+// deliverWebhook POSTs the finished job, retrying a few times with growing delays
+func deliverWebhook(webhookURL string, info api.Job) {
+	// the allowed hosts may have changed since a job loaded from disk was submitted
+	err := checkWebhookURL(webhookURL)
+	if err != nil {
+		log.Errorf("Not delivering job %s to webhook: %v", info.ID, err)
+		return
+	}
+	body, err := json.Marshal(info)
+	if err != nil {
+		log.Errorf("Failed to marshal job %s for webhook: %v", info.ID, err)
+		return
+	}
+
+	webhookSlots <- struct{}{}
+	defer func() { <-webhookSlots }()
+
+	delay := time.Second
+	for attempt := 1; attempt <= 3; attempt++ {
+		resp, err := webhookClient.Post(webhookURL, "application/json", bytes.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode/100 == 2 {
+				log.Debugf("Delivered job %s to webhook %s", info.ID, webhookURL)
+				return
+			}
+			err = fmt.Errorf("status %s", resp.Status)
+		}
+		log.Warningf("Failed to deliver job %s to webhook %s, attempt %d: %v", info.ID, webhookURL, attempt, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+	log.Errorf("Gave up delivering job %s to webhook %s", info.ID, webhookURL)
+}
+
+// handleJobs serves POST /v1/jobs - submit a job
+func handleJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSONError(w, http.StatusMethodNotAllowed, "", "only POST is allowed")
+		return
+	}
+
+	body := api.JobRequest{}
+	err := decodeJSONBody(w, r, &body)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "", err.Error())
+		return
+	}
+	if body.WebhookURL != "" {
+		err = checkWebhookURL(body.WebhookURL)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, body.RequestID, err.Error())
+			return
+		}
+	}
+
+	err = verifyExecuteSignature(body.ExecuteRequest)
+	if err != nil {
+		auditRejected(body.RequestID, body.Requester, body.BuildEnv, body.Target, fmt.Sprintf("Rejected request: %v", err))
+		writeJSONError(w, http.StatusUnauthorized, body.RequestID, fmt.Sprintf("Rejected request: %v", err))
+		return
+	}
+
+	info, err := jobs.submit(body)
+	if errors.Is(err, errTooManyJobs) {
+		writeJSONError(w, http.StatusTooManyRequests, body.RequestID, err.Error())
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, body.RequestID, err.Error())
+		return
+	}
+	log.Infof("Job %s submitted from %s", info.ID, r.RemoteAddr)
+	writeJSONResponse(w, http.StatusAccepted, info)
+}
+
+// handleJob serves:
+// GET /v1/jobs/<id> - job status and result
+// GET /v1/jobs/<id>/events - all messages sent for the job
+// POST /v1/jobs/<id>/cancel - stop the job
+func handleJob(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/jobs/"), "/")
+	j, ok := jobs.get(parts[0])
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "", fmt.Sprintf("job %s is not found", parts[0]))
+		return
+	}
+
+	action := ""
+	if len(parts) > 1 {
+		action = parts[1]
+	}
+	method := http.MethodGet
+	if action == "cancel" {
+		method = http.MethodPost
+	}
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeJSONError(w, http.StatusMethodNotAllowed, "", fmt.Sprintf("only %s is allowed", method))
+		return
+	}
+
+	switch action {
+	case "":
+		j.mu.Lock()
+		info := j.info
+		j.mu.Unlock()
+		writeJSONResponse(w, http.StatusOK, info)
+	case "events":
+		j.mu.Lock()
+		events := api.JobEvents{ID: j.info.ID, Events: append([]api.Envelope{}, j.events...), DroppedEvents: j.droppedEvents}
+		j.mu.Unlock()
+		writeJSONResponse(w, http.StatusOK, events)
+	case "cancel":
+		j.mu.Lock()
+		if j.cancel != nil && j.info.FinishedAt == nil {
+			j.cancel()
+		}
+		info := j.info
+		j.mu.Unlock()
+		writeJSONResponse(w, http.StatusAccepted, info)
+	default:
+		writeJSONError(w, http.StatusNotFound, "", fmt.Sprintf("unknown job action %s", action))
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/practicode-org/worker/src/api"
+	"github.com/practicode-org/worker/src/rules"
+)
+
+// localRequest is a request which doesn't come from a backend connection, but from the worker itself:
+// the command line, HTTP API, etc. Source files have plain (not base64 encoded) texts.
+type localRequest struct {
+	RequestID   string
+	BuildEnv    string
+	Target      string
+	Requester   string
+	TestSuite   *api.TestSuite
+	SourceFiles []api.SourceFile
+}
+
+// resolveLocalRequest checks the request and returns its build env and stages to run
+func resolveLocalRequest(req localRequest) (*rules.BuildStages, []*rules.Stage, error) {
+	if req.RequestID == "" {
+		return nil, nil, errors.New("request id is empty")
+	}
+	if req.Target == "" {
+		return nil, nil, errors.New("target is empty")
+	}
+	buildStages, err := buildEnvForRequest(req.BuildEnv)
+	if err != nil {
+		return nil, nil, err
+	}
+	stages, err := buildStages.StagesForTarget(req.Target)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to figure out rules for target %s: %w", req.Target, err)
+	}
+	if targetHasTests(req.Target) && req.TestSuite == nil {
+		return nil, nil, fmt.Errorf("target %s expects a test suite", req.Target)
+	} else if !targetHasTests(req.Target) && req.TestSuite != nil {
+		return nil, nil, fmt.Errorf("target %s doesn't expect a test suite", req.Target)
+	}
+	return buildStages, stages, nil
+}
+
+// executeLocal runs the request with the build env and stages resolveLocalRequest returned for it
+// through handleRequest feeding it the same messages a backend would send.
+// Every outgoing message is passed to onMessage, the last one is api.Finish.
+// Cancelling ctx stops the request.
+func executeLocal(ctx context.Context, req localRequest, buildStages *rules.BuildStages, stages []*rules.Stage, onMessage func(msg interface{})) error {
+	recvMessages := make(chan api.Envelope, 4)
+	sendMessages := make(chan interface{}, 256)
+
+	seq := uint64(1)
+	if req.TestSuite != nil {
+		env, err := api.NewEnvelope(api.TypeTestSuite, seq, req.TestSuite)
+		if err != nil {
+			return err
+		}
+		recvMessages <- env
+		seq++
+	}
+
+	sourcesMsg := api.ClientMessage{RequestID: req.RequestID}
+	for _, sf := range req.SourceFiles {
+		sourcesMsg.SourceFiles = append(sourcesMsg.SourceFiles, api.SourceFile{
+			Name: sf.Name,
+			Text: base64.StdEncoding.EncodeToString([]byte(sf.Text)),
+			Hash: fmt.Sprintf("%x", md5.Sum([]byte(sf.Text))),
+		})
+	}
+	env, err := api.NewEnvelope(api.TypeSourceFiles, seq, sourcesMsg)
+	if err != nil {
+		return err
+	}
+	recvMessages <- env
+
+	go handleRequest(ctx, req.RequestID, buildStages.Name, req.Target, req.Requester, "", stages, recvMessages, sendMessages)
+
+	for msg := range sendMessages {
+		onMessage(msg)
+		if _, ok := msg.(api.Finish); ok {
+			break
+		}
+	}
+	return nil
+}
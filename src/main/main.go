@@ -1,83 +1,313 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
+	"fmt"
 	"net/http"
 	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/practicode-org/worker/src/config"
 	"github.com/practicode-org/worker/src/rules"
 )
 
-func handleHealth(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
-}
-
+var configFlag = flag.String("config", "", "YAML file with settings, keys are names of these flags (WORKER_CONFIG if empty)")
 var rulesDirFlag = flag.String("rules-dir", "", "directory with .json or .yaml rules files")
-var buildEnvNameFlag = flag.String("build-env", "", "name of the buildenv")
+var buildEnvNameFlag = flag.String("build-env", "", "comma-separated names of build envs to load (all from rules-dir if empty)")
 var backendAddrFlag = flag.String("backend-addr", "", "backend's ip address (optional)")
+var reconnectMinDelayFlag = flag.Duration("reconnect-min-delay", time.Second, "delay before the first reconnect to the backend, doubles with every failed attempt")
+var reconnectMaxDelayFlag = flag.Duration("reconnect-max-delay", time.Minute, "max delay between reconnects to the backend")
+var resumeRequestsFlag = flag.Bool("resume-requests", false, "keep a request running when the connection to the backend is lost and send its results after reconnecting (it's stopped otherwise)")
+var receiveTimeoutFlag = flag.Duration("receive-timeout", time.Minute, "how long an accepted request waits for its test suite and source files before it fails, 0 waits forever")
+var maxMessageSizeFlag = flag.Int64("max-message-size", 1024*1024, "max size of a websocket message in bytes, the connection is closed if it's exceeded")
+var pingIntervalFlag = flag.Duration("ping-interval", time.Second*30, "how often to ping the other side of a websocket connection, 0 disables keepalive")
+var pongTimeoutFlag = flag.Duration("pong-timeout", time.Second*15, "how long to wait for anything from the other side after a ping before closing the connection")
+var writeTimeoutFlag = flag.Duration("write-timeout", time.Second*10, "max time to write a websocket message, the connection is closed if it's exceeded")
+var outputBufferFlag = flag.Int64("output-buffer-bytes", 1024*1024, "max program output per stage kept in memory while the client is slow to take it, the rest is dropped")
+var drainTimeoutFlag = flag.Duration("drain-timeout", time.Second*25, "on SIGTERM how long to let running requests finish before stopping them, keep it below the orchestrator's kill timeout")
+var metricsAddrFlag = flag.String("metrics-addr", "", "listen interface and port for /health, /ready and /metrics only, ex: 0.0.0.0:9100, useful with backend-addr (disabled if empty)")
+var minFreeDiskMbFlag = flag.Int64("min-free-disk-mb", 100, "health checks fail if the sources directory has less free space")
+var otlpEndpointFlag = flag.String("otlp-endpoint", "", "OTLP gRPC collector to export request traces to, ex: localhost:4317 (tracing is disabled if empty)")
+var otlpInsecureFlag = flag.Bool("otlp-insecure", false, "connect to the OTLP collector without TLS")
+var auditLogFlag = flag.String("audit-log", "", "file to write a JSON line per executed request to (disabled if empty)")
+var auditLogMaxMbFlag = flag.Int64("audit-log-max-mb", 100, "the audit log is rotated once it grows over that size")
+var auditLogMaxFilesFlag = flag.Int("audit-log-max-files", 10, "how many rotated audit log files to keep")
+var auditSourcesDirFlag = flag.String("audit-sources-dir", "", "directory to keep the submitted sources of every request in, for the audit log (not kept if empty)")
 var listenAddrFlag = flag.String("listen-addr", "0.0.0.0:1556", "listen interface and port")
+var allowedOriginsFlag = flag.String("allowed-origins", "", "comma-separated origins allowed to connect to /run in listen mode, \"*\" allows any (same host only if empty)")
+var grpcAddrFlag = flag.String("grpc-addr", "", "listen interface and port for the gRPC API, ex: 0.0.0.0:1557 (disabled if empty)")
+var jobsDirFlag = flag.String("jobs-dir", "", "directory to keep async jobs in, so they survive restarts (in memory only if empty)")
+var jobsTTLFlag = flag.Duration("jobs-ttl", time.Hour*24, "how long finished async jobs are kept, 0 keeps them forever")
+var maxQueuedJobsFlag = flag.Int("max-queued-jobs", 100, "max async jobs queued or running at the same time, more are rejected")
+var maxJobsFlag = flag.Int("max-jobs", 1000, "max async jobs kept, the oldest finished ones are forgotten to make room for new ones")
+var webhookAllowedHostsFlag = flag.String("webhook-allowed-hosts", "", "comma-separated hosts (or host:port) job webhooks may be sent to (webhooks are disabled if empty)")
+var rulesWatchIntervalFlag = flag.Duration("rules-watch-interval", 0, "how often to check rules-dir for changes, 0 disables it (SIGHUP always reloads rules)")
+var backendTokenFlag = flag.String("backend-token", "", "bearer token sent to the backend when dialing it")
+var backendHMACSecretFlag = flag.String("backend-hmac-secret", "", "secret to sign the backend dial with HMAC-SHA256 (X-Worker-Timestamp and X-Worker-Signature headers)")
+var backendTLSFlag = flag.Bool("backend-tls", false, "dial the backend over wss://")
+var backendCAFlag = flag.String("backend-ca", "", "CA certificate file to verify the backend with (system CAs if empty)")
+var backendCertFlag = flag.String("backend-cert", "", "client certificate file presented to the backend")
+var backendKeyFlag = flag.String("backend-key", "", "client certificate key file")
+var listenTokenFlag = flag.String("listen-token", "", "bearer token clients must send to /run, /v1/ endpoints and gRPC (no authentication if empty)")
+var tlsCertFlag = flag.String("tls-cert", "", "certificate file to serve https/wss and gRPC over TLS")
+var tlsKeyFlag = flag.String("tls-key", "", "certificate key file")
+var tlsClientCAFlag = flag.String("tls-client-ca", "", "CA certificate file, clients must present certificates signed by it (requires tls-cert)")
+var requestSecretFlag = flag.String("request-secret", "", "secret for HMAC-SHA256 signatures of requests (\"new\" messages, /v1/execute, /v1/jobs and gRPC Execute), unsigned requests are rejected if set")
+var concurrencyFlag = flag.Int("concurrency", 1, "how many requests may run at the same time, more than 1 is safe only if stages write only to {out}")
 var logLevelFlag = flag.String("log-level", "info", "verbosity level: panic, fatal, error, warn, info, debug, trace")
+var logFormatFlag = flag.String("log-format", "text", "log format: text or json")
+
+// allowed values of settings of the worker and its subcommands, every numeric setting must be here
+var settingLimits = config.Limits{
+	Positive: []string{"reconnect-min-delay", "reconnect-max-delay", "max-message-size", "write-timeout", "output-buffer-bytes",
+		"audit-log-max-mb", "max-queued-jobs", "max-jobs", "concurrency", "parallel"},
+	NonNegative: []string{"receive-timeout", "ping-interval", "pong-timeout", "drain-timeout", "min-free-disk-mb",
+		"audit-log-max-files", "jobs-ttl", "rules-watch-interval"},
+	NotLess:  map[string]string{"reconnect-max-delay": "reconnect-min-delay", "max-jobs": "max-queued-jobs"},
+	NonEmpty: []string{"rules-dir"},
+	Requires: map[string]string{"audit-sources-dir": "audit-log"},
+}
+
+// every flag can also be set by an environment variable, ex: WORKER_LISTEN_ADDR for listen-addr
+const envPrefix = "WORKER_"
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [flags]\n", os.Args[0])
+	fmt.Fprintf(out, "       %s validate -rules-dir <dir> [-build-env <names>]\n", os.Args[0])
+	fmt.Fprintf(out, "       %s plan -rules-dir <dir> [-sources <files>] <build-env> <target>\n", os.Args[0])
+	fmt.Fprintf(out, "       %s run -rules-dir <dir> [-env <build-env>] -target <target> [-tests <suite.json>] <source files...>\n", os.Args[0])
+	fmt.Fprintf(out, "       %s grade -rules-dir <dir> [-env <build-env>] -target <target> [-tests <suite.json>] [-parallel <n>] [-report <file>] <submissions dir>\n", os.Args[0])
+	fmt.Fprintf(out, "\nFlags (can also be set in the config file or by %s<FLAG_NAME> environment variables):\n", envPrefix)
+	flag.PrintDefaults()
+}
+
+// configPath returns the config file given by -config or WORKER_CONFIG
+func configPath(flagValue string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	return os.Getenv(config.EnvName(envPrefix, "config"))
+}
+
+// parseCommandFlags parses flags of a subcommand, the ones not given on the command line are taken
+// from the config file and the environment like the worker's own flags
+func parseCommandFlags(flags *flag.FlagSet, args []string) error {
+	path := flags.String("config", "", "YAML file with settings of the worker, only the ones this command has are used (WORKER_CONFIG if empty)")
+	flags.Parse(args)
+	_, err := config.LoadShared(flags, configPath(*path), envPrefix)
+	return err
+}
 
 func main() {
-	err := config.DefaultConfig()
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "validate":
+			os.Exit(runValidate(os.Args[2:]))
+		case "plan":
+			os.Exit(runPlan(os.Args[2:]))
+		case "run":
+			os.Exit(runRun(os.Args[2:]))
+		case "grade":
+			os.Exit(runGrade(os.Args[2:]))
+		}
+	}
+
+	flag.Usage = usage
+	config.AddFlags(flag.CommandLine)
+	flag.Parse()
+
+	origins, err := config.Load(flag.CommandLine, configPath(*configFlag), envPrefix)
 	if err != nil {
 		log.Fatalf("Config error: %v", err)
 	}
-	flag.Parse()
 
 	level, err := log.ParseLevel(*logLevelFlag)
 	if err != nil {
 		log.Fatalf("Failed to parse log-level: %v", err)
 	}
 	log.SetLevel(level)
-
-	if *rulesDirFlag == "" {
-		log.Fatalf("Fatal: rules-dir is empty")
+	switch *logFormatFlag {
+	case "text":
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		log.Fatalf("Fatal: unknown log-format %s", *logFormatFlag)
 	}
-	if *buildEnvNameFlag == "" {
-		log.Fatalf("Fatal: build-env is empty")
+	config.Print(flag.CommandLine, origins)
+
+	err = config.Validate(flag.CommandLine, settingLimits)
+	if err != nil {
+		log.Fatalf("Config error: %v", err)
 	}
+	setRequestConcurrency(*concurrencyFlag)
 
-	err = rules.LoadBuildStages(*rulesDirFlag, *buildEnvNameFlag)
+	var buildEnvNames []string
+	if *buildEnvNameFlag != "" {
+		buildEnvNames = strings.Split(*buildEnvNameFlag, ",")
+	}
+	err = rules.LoadBuildEnvs(*rulesDirFlag, buildEnvNames)
 	if err != nil {
 		log.Fatalf("Error: %v", err)
 	}
+	log.Infof("Loaded build envs: %s", strings.Join(rules.BuildEnvNames(), ", "))
+	go watchRules(*rulesDirFlag, buildEnvNames, *rulesWatchIntervalFlag)
+	go drainOnSignal(*drainTimeoutFlag)
+
+	if *otlpEndpointFlag != "" {
+		shutdownTracing, err := initTracing(*otlpEndpointFlag, *otlpInsecureFlag)
+		if err != nil {
+			log.Fatalf("Tracing error: %v", err)
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+			defer cancel()
+			err := shutdownTracing(ctx)
+			if err != nil {
+				log.Errorf("Failed to flush traces: %v", err)
+			}
+		}()
+		log.Infof("Exporting traces to %s", *otlpEndpointFlag)
+	}
+
+	if *auditLogFlag != "" {
+		audit, err = openAuditLog(*auditLogFlag, *auditLogMaxMbFlag*1024*1024, *auditLogMaxFilesFlag, *auditSourcesDirFlag)
+		if err != nil {
+			log.Fatalf("Audit log error: %v", err)
+		}
+		log.Infof("Writing audit log to %s", *auditLogFlag)
+	}
+
+	var listenTLS *tls.Config
+	if *tlsCertFlag != "" || *tlsKeyFlag != "" {
+		listenTLS, err = listenTLSConfig(*tlsCertFlag, *tlsKeyFlag, *tlsClientCAFlag)
+		if err != nil {
+			log.Fatalf("TLS config error: %v", err)
+		}
+	} else if *tlsClientCAFlag != "" {
+		log.Fatalf("Fatal: tls-client-ca requires tls-cert and tls-key")
+	}
+
+	if *metricsAddrFlag != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.HandleFunc("/health", handleHealth)
+			mux.HandleFunc("/ready", handleReady)
+			mux.Handle("/metrics", promhttp.Handler())
+			log.Infof("Serving metrics on %s", *metricsAddrFlag)
+			err := http.ListenAndServe(*metricsAddrFlag, mux)
+			if err != nil {
+				log.Fatalf("Failed to serve metrics: %v", err)
+			}
+		}()
+	}
+
+	if *grpcAddrFlag != "" {
+		go func() {
+			err := serveGRPC(*grpcAddrFlag, listenTLS, *listenTokenFlag)
+			if err != nil {
+				log.Fatalf("Failed to serve gRPC: %v", err)
+			}
+		}()
+	}
 
 	backendAddr := *backendAddrFlag
 	if backendAddr != "" {
-		u := url.URL{Scheme: "ws", Host: backendAddr, Path: "/bridge", RawQuery: "build_env=" + *buildEnvNameFlag}
-		log.Infof("Auto-connect to backend mode, will dial to: %s", u.String())
-
-		for {
-			dialer := websocket.Dialer{Proxy: http.ProxyFromEnvironment, HandshakeTimeout: time.Second * 10}
-			conn, _, err := dialer.Dial(u.String(), nil)
+		query := url.Values{}
+		for _, name := range rules.BuildEnvNames() {
+			query.Add("build_env", name)
+		}
+		u := url.URL{Scheme: "ws", Host: backendAddr, Path: "/bridge", RawQuery: query.Encode()}
+		dialer := websocket.Dialer{Proxy: http.ProxyFromEnvironment, HandshakeTimeout: time.Second * 10}
+		if *backendTLSFlag {
+			u.Scheme = "wss"
+			dialer.TLSClientConfig, err = backendTLSConfig(*backendCAFlag, *backendCertFlag, *backendKeyFlag)
 			if err != nil {
+				log.Fatalf("Backend TLS config error: %v", err)
+			}
+		}
+		log.Infof("Auto-connect to backend mode, will dial to: %s", u.String())
+		delays := backoff{min: *reconnectMinDelayFlag, max: *reconnectMaxDelayFlag}
+		session := &backendSession{resume: *resumeRequestsFlag}
+		// when draining, reconnect only to send results of a request which kept running while disconnected
+		for !drain.isDraining() || session.active != nil {
+			header := backendDialHeader(*backendTokenFlag, *backendHMACSecretFlag, u.RequestURI())
+			conn, _, err := dialer.Dial(u.String(), header)
+			if err == nil {
+				log.Infof("Connected to the backend %s", backendAddr)
+				connectedAt := time.Now()
+				atomic.StoreInt32(&backendConnected, 1)
+				handshakeDone := handleBackendConnection(conn, "", session) // Note: connection is closed inside
+				atomic.StoreInt32(&backendConnected, 0)
+				if handshakeDone && time.Since(connectedAt) > stableConnectionTime {
+					delays.reset()
+				}
+			} else {
 				log.Errorf("Failed to connect to %s: %v", u.String(), err)
-				time.Sleep(time.Second * 3)
-				continue
 			}
 
-			log.Infof("Connected to the backend %s", backendAddr)
-			handleBackendConnection(conn) // Note: connection is closed inside
-			time.Sleep(time.Second * 3)
+			delay := delays.next()
+			log.Infof("Reconnecting in %v", delay.Round(time.Millisecond))
+			select {
+			case <-time.After(delay):
+			case <-drain.done:
+				return
+			}
+			backendReconnectsTotal.Inc()
 		}
+		<-drain.done
 	} else {
 		listenAddr := *listenAddrFlag
 		log.Infof("Stay and listen mode, will listen on: %s", listenAddr)
 
+		var allowedOrigins []string
+		if *allowedOriginsFlag != "" {
+			allowedOrigins = strings.Split(*allowedOriginsFlag, ",")
+		}
+
 		http.HandleFunc("/health", handleHealth)
-		/*http.HandleFunc("/run", func(rs http.ResponseWriter, r *http.Request) {
-			handleRun(rs, r, *buildEnvNameFlag)
-		})*/
+		http.HandleFunc("/ready", handleReady)
+		http.Handle("/metrics", promhttp.Handler())
+		http.HandleFunc("/run", requireToken(*listenTokenFlag, func(w http.ResponseWriter, r *http.Request) {
+			handleRun(w, r, allowedOrigins)
+		}))
+		http.HandleFunc("/v1/execute", requireToken(*listenTokenFlag, handleExecute))
 
-		err = http.ListenAndServe(listenAddr, nil)
+		jobs, err = newJobStore(*jobsDirFlag, *jobsTTLFlag, *maxQueuedJobsFlag, *maxJobsFlag)
 		if err != nil {
+			log.Fatalf("Failed to init job store: %v", err)
+		}
+		http.HandleFunc("/v1/jobs", requireToken(*listenTokenFlag, handleJobs))
+		http.HandleFunc("/v1/jobs/", requireToken(*listenTokenFlag, handleJob))
+
+		if *listenTokenFlag == "" && *tlsClientCAFlag == "" {
+			log.Warningf("Listening without authentication, anyone who can reach %s can run code", listenAddr)
+		}
+		server := &http.Server{Addr: listenAddr, TLSConfig: listenTLS}
+		go func() {
+			// stop listening, websocket connections close themselves once their requests are done
+			<-drain.started
+			ctx, cancel := context.WithTimeout(context.Background(), *drainTimeoutFlag+drainKillGrace)
+			defer cancel()
+			server.Shutdown(ctx)
+		}()
+		if listenTLS != nil {
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Failed to server: %v", err)
 		}
+		<-drain.done
 	}
 }
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+
+	"github.com/practicode-org/worker/src/config"
+)
+
+func TestEveryNumericSettingHasLimits(t *testing.T) {
+	limited := map[string]bool{}
+	for _, name := range append(settingLimits.Positive, settingLimits.NonNegative...) {
+		limited[name] = true
+	}
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		// sources-size-limit-bytes is checked along with the other config.Cfg settings
+		if strings.HasPrefix(f.Name, "test.") || f.Name == "sources-size-limit-bytes" {
+			return
+		}
+		if config.IsNumeric(f) && !limited[f.Name] {
+			t.Errorf("numeric setting %s isn't in settingLimits", f.Name)
+		}
+	})
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/practicode-org/worker/src/rules"
+)
+
+// request outcomes
+const (
+	outcomeSuccess  = "success"
+	outcomeFailed   = "failed"   // a stage or a test case failed
+	outcomeError    = "error"    // the request couldn't run, ex: bad source files
+	outcomeStopped  = "stopped"  // stopped by the client, a lost connection or shutdown
+	outcomeRejected = "rejected" // the worker is shutting down
+)
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "worker",
+		Name:      "requests_total",
+		Help:      "Finished requests by build env, target and outcome.",
+	}, []string{"build_env", "target", "outcome"})
+
+	queueWaitSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "worker",
+		Name:      "queue_wait_seconds",
+		Help:      "Time requests wait for a free slot before running.",
+		Buckets:   []float64{0.01, 0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+	})
+
+	stageDurationSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "worker",
+		Name:      "stage_duration_seconds",
+		Help:      "Duration of stage runs by build env and stage.",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2, 3, 5, 10, 20, 30, 60},
+	}, []string{"build_env", "stage"})
+
+	stageExitCodesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "worker",
+		Name:      "stage_exit_codes_total",
+		Help:      "Stage runs by build env, stage and exit code.",
+	}, []string{"build_env", "stage", "exit_code"})
+
+	limitViolationsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "worker",
+		Name:      "limit_violations_total",
+		Help:      "Stage runs which exceeded a limit, by build env, stage and limit (output_bytes, run_time_sec, file_writes_mb).",
+	}, []string{"build_env", "stage", "limit"})
+
+	outputBytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "worker",
+		Name:      "output_bytes_total",
+		Help:      "Output of programs by build env, stage and stream.",
+	}, []string{"build_env", "stage", "stream"})
+
+	outputDroppedBytesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "worker",
+		Name:      "output_dropped_bytes_total",
+		Help:      "Output dropped because clients were too slow to take it.",
+	})
+
+	activeJails = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "worker",
+		Name:      "active_jails",
+		Help:      "Jailed processes running now.",
+	})
+
+	backendReconnectsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "worker",
+		Name:      "backend_reconnects_total",
+		Help:      "Attempts to reconnect to the backend after a failed dial or a lost connection.",
+	})
+
+	websocketConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "worker",
+		Name:      "websocket_connections",
+		Help:      "Open websocket connections, to the backend or from clients.",
+	})
+)
+
+// outcomeOf returns outcomeStopped if the request was stopped, otherwise the given outcome
+func outcomeOf(ctx context.Context, outcome string) string {
+	if ctx.Err() != nil {
+		return outcomeStopped
+	}
+	return outcome
+}
+
+// observeStageRun records a finished stage run and returns the limit it exceeded, if any. outputExceeded tells
+// that the process was killed because of its output, stopped - because the request was stopped
+func observeStageRun(buildEnv string, stage *rules.Stage, exitCode int, duration time.Duration, outputExceeded bool, stopped bool) string {
+	stageDurationSeconds.WithLabelValues(buildEnv, stage.Name).Observe(duration.Seconds())
+	stageExitCodesTotal.WithLabelValues(buildEnv, stage.Name, strconv.Itoa(exitCode)).Inc()
+	limit := exceededLimit(stage, exitCode, duration, outputExceeded, stopped)
+	if limit != "" {
+		limitViolationsTotal.WithLabelValues(buildEnv, stage.Name, limit).Inc()
+	}
+	return limit
+}
+
+// exceededLimit guesses which limit the stage run exceeded, nsjail exits with 128 + signal if the program was killed:
+// SIGKILL after the time limit, SIGXFSZ after writing too much. Empty if none.
+func exceededLimit(stage *rules.Stage, exitCode int, duration time.Duration, outputExceeded bool, stopped bool) string {
+	switch {
+	case outputExceeded:
+		return "output_bytes"
+	case stopped:
+		return ""
+	case exitCode == 128+int(syscall.SIGKILL) && duration.Seconds() >= float64(stage.Limits.RunTime):
+		return "run_time_sec"
+	case exitCode == 128+int(syscall.SIGXFSZ):
+		return "file_writes_mb"
+	}
+	return ""
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/practicode-org/worker/src/rules"
+)
+
+// reloadNotifier signals every subscribed connection after rules are reloaded, so it sends new capabilities
+type reloadNotifier struct {
+	mu   sync.Mutex
+	subs map[chan struct{}]struct{}
+}
+
+var rulesReloaded = &reloadNotifier{subs: map[chan struct{}]struct{}{}}
+
+func (n *reloadNotifier) subscribe() chan struct{} {
+	ch := make(chan struct{}, 1)
+	n.mu.Lock()
+	n.subs[ch] = struct{}{}
+	n.mu.Unlock()
+	return ch
+}
+
+func (n *reloadNotifier) unsubscribe(ch chan struct{}) {
+	n.mu.Lock()
+	delete(n.subs, ch)
+	n.mu.Unlock()
+}
+
+func (n *reloadNotifier) notify() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for ch := range n.subs {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func reloadRules(rulesDir string, buildEnvNames []string) {
+	diff, err := rules.ReloadBuildEnvs(rulesDir, buildEnvNames)
+	if err != nil {
+		log.Errorf("Failed to reload rules, keep using the current ones: %v", err)
+		return
+	}
+	log.Infof("Rules reloaded: %s", diff)
+	rulesReloaded.notify()
+}
+
+// rulesDirState returns a string which changes whenever any rules file is added, removed or modified
+func rulesDirState(rulesDir string) string {
+	filePaths, _ := filepath.Glob(filepath.Join(rulesDir, "*.yml"))
+	state := ""
+	for _, filePath := range filePaths {
+		stat, err := os.Stat(filePath)
+		if err != nil {
+			continue
+		}
+		state += fmt.Sprintf("%s:%d:%d;", filePath, stat.Size(), stat.ModTime().UnixNano())
+	}
+	return state
+}
+
+// watchRules reloads rules on SIGHUP and, if interval isn't zero, whenever files in the rules directory change
+func watchRules(rulesDir string, buildEnvNames []string, interval time.Duration) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	state := rulesDirState(rulesDir)
+	for {
+		select {
+		case <-sighup:
+			log.Infof("Got SIGHUP, reloading rules from %s", rulesDir)
+			state = rulesDirState(rulesDir)
+			reloadRules(rulesDir, buildEnvNames)
+		case <-tick:
+			newState := rulesDirState(rulesDir)
+			if newState == state {
+				continue
+			}
+			log.Infof("Rules files in %s changed, reloading", rulesDir)
+			state = newState
+			reloadRules(rulesDir, buildEnvNames)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/base64"
+
+	"github.com/practicode-org/worker/src/api"
+	"github.com/practicode-org/worker/src/rules"
+)
+
+// requestResult accumulates outgoing messages of a request into a single api.ExecuteResponse
+type requestResult struct {
+	stages   *rules.BuildStages
+	target   string
+	response api.ExecuteResponse
+	failed   bool
+	// index of the latest result of a stage in response.Stages
+	current map[string]int
+	// decoded output bytes of the latest result of a stage
+	output map[string]uint64
+}
+
+func newRequestResult(requestID string, stages *rules.BuildStages, target string) *requestResult {
+	return &requestResult{
+		stages: stages,
+		target: target,
+		response: api.ExecuteResponse{
+			RequestID:   requestID,
+			Stages:      []api.StageResult{},
+			TestResults: []api.TestResult{},
+			Errors:      []api.Error{},
+		},
+		current: make(map[string]int),
+		output:  make(map[string]uint64),
+	}
+}
+
+func (r *requestResult) stageResult(stage string) *api.StageResult {
+	idx, ok := r.current[stage]
+	if !ok {
+		r.response.Stages = append(r.response.Stages, api.StageResult{Stage: stage})
+		idx = len(r.response.Stages) - 1
+		r.current[stage] = idx
+	}
+	return &r.response.Stages[idx]
+}
+
+func (r *requestResult) add(msg interface{}) {
+	switch m := msg.(type) {
+	case api.StageEvent:
+		if m.Event == "started" || m.Event == "skipped" {
+			r.response.Stages = append(r.response.Stages, api.StageResult{Stage: m.Stage, TestCase: m.TestCase, Skipped: m.Event == "skipped"})
+			r.current[m.Stage] = len(r.response.Stages) - 1
+			r.output[m.Stage] = 0
+		}
+	case api.Output:
+		text, err := base64.StdEncoding.DecodeString(m.Text)
+		if err != nil {
+			return
+		}
+		result := r.stageResult(m.Stage)
+		if stage, ok := r.stages.StageMap[m.Stage]; ok {
+			left := stage.Limits.Output - r.output[m.Stage]
+			if uint64(len(text)) > left {
+				text = text[:left]
+				result.OutputTruncated = true
+			}
+		}
+		r.output[m.Stage] += uint64(len(text))
+		if m.Type == "stderr" {
+			result.Stderr += string(text)
+		} else {
+			result.Stdout += string(text)
+		}
+	case api.OutputDropped:
+		r.stageResult(m.Stage).OutputTruncated = true
+	case api.ExitCode:
+		exitCode := m.ExitCode
+		r.stageResult(m.Stage).ExitCode = &exitCode
+		// exit codes of test runs are judged by test checks
+		if m.Stage == r.target && targetHasTests(r.target) {
+			break
+		}
+		stage, ok := r.stages.StageMap[m.Stage]
+		if ok && !stage.ExitCodeAllowed(m.ExitCode) && !stage.ContinueOnFailure {
+			r.failed = true
+		}
+	case api.Duration:
+		r.stageResult(m.Stage).DurationSec = m.DurationSec
+	case api.ResourceUsage:
+		result := r.stageResult(m.Stage)
+		result.MaxRSSKb = m.MaxRSSKb
+		result.CPUTimeSec = m.CPUTimeSec
+	case api.TestResult:
+		r.response.TestResults = append(r.response.TestResults, m)
+		if !m.Result {
+			r.failed = true
+		}
+	case api.Error:
+		r.response.Errors = append(r.response.Errors, m)
+		r.failed = true
+	}
+}
+
+// Failed tells whether some stage or test case has failed so far
+func (r *requestResult) Failed() bool {
+	return r.failed
+}
+
+func (r *requestResult) Response() api.ExecuteResponse {
+	response := r.response
+	response.Success = !r.failed
+	return response
+}
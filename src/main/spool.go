@@ -0,0 +1,94 @@
+package main
+
+import (
+	"sync"
+)
+
+// output chunks queued in a spool are merged into messages up to that size
+const maxOutputMessageBytes = 16 * 1024
+
+type outputChunk struct {
+	type_ string // "stdout" or "stderr"
+	data  []byte
+}
+
+// outputSpool keeps program output until it's sent, so the program never waits for a slow client
+// and its run time doesn't depend on the client's bandwidth. Output which doesn't fit into the limit is dropped.
+type outputSpool struct {
+	mu      sync.Mutex
+	chunks  []outputChunk
+	size    uint64 // bytes in chunks
+	limit   uint64
+	dropped uint64
+	closed  bool
+	notify  chan struct{} // signalled when chunks are added or the spool is closed
+}
+
+func newOutputSpool(limit uint64) *outputSpool {
+	return &outputSpool{limit: limit, notify: make(chan struct{}, 1)}
+}
+
+func (s *outputSpool) signal() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// write queues the data, never blocks
+func (s *outputSpool) write(type_ string, data []byte) {
+	s.mu.Lock()
+	left := s.limit - s.size
+	if uint64(len(data)) > left {
+		s.dropped += uint64(len(data)) - left
+		data = data[:left]
+	}
+	if len(data) != 0 {
+		s.chunks = append(s.chunks, outputChunk{type_: type_, data: data})
+		s.size += uint64(len(data))
+	}
+	s.mu.Unlock()
+	s.signal()
+}
+
+// close tells that there will be no more output, write must not be called after it
+func (s *outputSpool) close() {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	s.signal()
+}
+
+// take returns queued output with adjacent chunks of the same type merged
+func (s *outputSpool) take() ([]outputChunk, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	merged := []outputChunk{}
+	for _, chunk := range s.chunks {
+		last := len(merged) - 1
+		if last >= 0 && merged[last].type_ == chunk.type_ && len(merged[last].data)+len(chunk.data) <= maxOutputMessageBytes {
+			merged[last].data = append(merged[last].data, chunk.data...)
+			continue
+		}
+		merged = append(merged, outputChunk{type_: chunk.type_, data: append([]byte{}, chunk.data...)})
+	}
+	s.chunks = nil
+	s.size = 0
+	return merged, s.closed
+}
+
+// forward passes queued output to send until the spool is closed, returns how many bytes were dropped
+func (s *outputSpool) forward(send func(type_ string, data []byte)) uint64 {
+	for {
+		chunks, closed := s.take()
+		for _, chunk := range chunks {
+			send(chunk.type_, chunk.data)
+		}
+		if closed {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return s.dropped
+		}
+		<-s.notify
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestOutputSpoolDropsOverLimit(t *testing.T) {
+	s := newOutputSpool(10)
+	s.write("stdout", []byte("12345"))
+	s.write("stderr", []byte("678"))
+	s.write("stdout", []byte("90abc")) // only "90" fits
+	s.write("stdout", []byte("def"))   // nothing fits
+
+	chunks, closed := s.take()
+	if closed {
+		t.Error("the spool isn't closed yet")
+	}
+	want := []outputChunk{{"stdout", []byte("12345")}, {"stderr", []byte("678")}, {"stdout", []byte("90")}}
+	if len(chunks) != len(want) {
+		t.Fatalf("got %d chunks, want %d", len(chunks), len(want))
+	}
+	for i := range want {
+		if chunks[i].type_ != want[i].type_ || !bytes.Equal(chunks[i].data, want[i].data) {
+			t.Errorf("chunk %d = %s %q, want %s %q", i, chunks[i].type_, chunks[i].data, want[i].type_, want[i].data)
+		}
+	}
+
+	// taken output frees the room
+	s.write("stdout", []byte("ghi"))
+	s.close()
+	var delivered uint64
+	dropped := s.forward(func(type_ string, data []byte) { delivered += uint64(len(data)) })
+	if delivered != 3 {
+		t.Errorf("delivered %d bytes after take, want 3", delivered)
+	}
+	if dropped != 6 {
+		t.Errorf("dropped = %d, want 6", dropped)
+	}
+}
+
+func TestOutputSpoolForward(t *testing.T) {
+	const limit = 1000
+	s := newOutputSpool(limit)
+
+	var written uint64
+	go func() {
+		for i := 0; i < 100; i++ {
+			data := []byte(strings.Repeat("x", 37))
+			written += uint64(len(data))
+			s.write("stdout", data)
+		}
+		s.close()
+	}()
+
+	var delivered uint64
+	dropped := s.forward(func(type_ string, data []byte) {
+		if type_ != "stdout" {
+			t.Errorf("unexpected output type %s", type_)
+		}
+		if len(data) > maxOutputMessageBytes {
+			t.Errorf("message of %d bytes is over %d", len(data), maxOutputMessageBytes)
+		}
+		delivered += uint64(len(data))
+	})
+	if delivered+dropped != written {
+		t.Errorf("delivered %d + dropped %d != written %d", delivered, dropped, written)
+	}
+	if delivered < limit {
+		t.Errorf("delivered %d bytes, at least the limit %d fits", delivered, limit)
+	}
+}
+
+func TestOutputSpoolMergesChunks(t *testing.T) {
+	s := newOutputSpool(maxOutputMessageBytes * 4)
+	chunk := bytes.Repeat([]byte("x"), maxOutputMessageBytes/2+1)
+	for i := 0; i < 3; i++ {
+		s.write("stdout", chunk)
+	}
+	// every message takes at most maxOutputMessageBytes, so two chunks never fit into one
+	chunks, _ := s.take()
+	if len(chunks) != 3 {
+		t.Errorf("got %d chunks, want 3", len(chunks))
+	}
+	s.write("stderr", []byte("a"))
+	s.write("stderr", []byte("b"))
+	chunks, _ = s.take()
+	if len(chunks) != 1 || string(chunks[0].data) != "ab" {
+		t.Errorf("adjacent chunks of the same type aren't merged: %v", chunks)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/practicode-org/worker/src/rules"
+)
+
+// spans of requests, a no-op until initTracing sets the global provider
+var tracer trace.Tracer = otel.Tracer("github.com/practicode-org/worker")
+
+// initTracing exports spans to the OTLP gRPC collector at endpoint (host:port),
+// the returned function flushes spans which weren't exported yet
+func initTracing(endpoint string, insecure bool) (func(context.Context) error, error) {
+	options := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(endpoint)}
+	if insecure {
+		options = append(options, otlptracegrpc.WithInsecure())
+	}
+	exporter, err := otlptracegrpc.New(context.Background(), options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName("practicode-worker")))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace resource: %w", err)
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return provider.Shutdown, nil
+}
+
+// contextWithTraceParent continues the trace of the client which sent the request, traceParent and traceState
+// are W3C trace context headers
+func contextWithTraceParent(ctx context.Context, traceParent string, traceState string) context.Context {
+	if traceParent == "" {
+		return ctx
+	}
+	carrier := propagation.MapCarrier{"traceparent": traceParent, "tracestate": traceState}
+	return propagation.TraceContext{}.Extract(ctx, carrier)
+}
+
+// endSpan marks the span failed if err isn't nil and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func limitsAttributes(limits *rules.Limits) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.Int64("limits.address_space_mb", int64(limits.AddressSpace)),
+		attribute.Float64("limits.run_time_sec", float64(limits.RunTime)),
+		attribute.Int64("limits.file_descriptors", int64(limits.FileDescriptors)),
+		attribute.Int64("limits.file_writes_mb", int64(limits.FileWrites)),
+		attribute.Int64("limits.threads", int64(limits.Threads)),
+		attribute.Int64("limits.output_bytes", int64(limits.Output)),
+	}
+}
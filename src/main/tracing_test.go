@@ -0,0 +1,188 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/practicode-org/worker/src/config"
+	"github.com/practicode-org/worker/src/rules"
+)
+
+// stand-in for nsjail which runs the command after "--" without a jail
+const fakeNsjail = `#!/bin/sh
+while [ "$#" -gt 0 ] && [ "$1" != "--" ]; do shift; done
+shift
+exec "$@"
+`
+
+const tracingRules = `
+stages:
+  - name: compile
+    command: "/bin/echo compiled"
+    limits: {address_space_mb: 100, run_time_sec: 5, file_descriptors: 10, file_writes_mb: 1, threads: 100, output_bytes: 2000}
+  - name: run_tests
+    depends_on: compile
+    command: "/bin/sh {sources}"
+    limits: {address_space_mb: 100, run_time_sec: 5, file_descriptors: 10, file_writes_mb: 1, threads: 100, output_bytes: 2000}
+`
+
+// useTestWorker loads the rules with a fake nsjail and records spans of requests
+func useTestWorker(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	dir := t.TempDir()
+	nsjailPath := filepath.Join(dir, "nsjail")
+	if err := ioutil.WriteFile(nsjailPath, []byte(fakeNsjail), 0755); err != nil {
+		t.Fatal(err)
+	}
+	sourcesDir := filepath.Join(dir, "sources")
+	rulesDir := filepath.Join(dir, "rules")
+	for _, d := range []string{sourcesDir, rulesDir} {
+		if err := os.Mkdir(d, 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(rulesDir, "sh.yml"), []byte(tracingRules), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := rules.LoadBuildEnvs(rulesDir, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	savedCfg, savedTracer := config.Cfg, tracer
+	config.Cfg.NsjailPath = nsjailPath
+	config.Cfg.SourcesDir = sourcesDir
+	config.Cfg.SourcesSizeLimitBytes = 8000
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	tracer = provider.Tracer("test")
+	t.Cleanup(func() {
+		config.Cfg, tracer = savedCfg, savedTracer
+	})
+	return recorder
+}
+
+func spanAttribute(span sdktrace.ReadOnlySpan, key attribute.Key) (attribute.Value, bool) {
+	for _, kv := range span.Attributes() {
+		if kv.Key == key {
+			return kv.Value, true
+		}
+	}
+	return attribute.Value{}, false
+}
+
+func TestRequestSpans(t *testing.T) {
+	recorder := useTestWorker(t)
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	const parentSpanID = "00f067aa0ba902b7"
+	body := `{"request_id": "traced", "build_env": "sh", "target": "run_tests",
+		"source_files": [{"name": "main.sh", "text": "echo hello; exit 0"}],
+		"test_suite": {"test_cases": [
+			{"description": "exit 0", "checks": [{"type": "exit_code", "arg": "0"}]},
+			{"description": "exit 1", "checks": [{"type": "exit_code", "arg": "1"}]}
+		]}}`
+	r := httptest.NewRequest(http.MethodPost, "/v1/execute", strings.NewReader(body))
+	r.Header.Set("traceparent", "00-"+traceID+"-"+parentSpanID+"-01")
+	w := httptest.NewRecorder()
+	handleExecute(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+
+	spans := recorder.Ended()
+	byName := make(map[string][]sdktrace.ReadOnlySpan)
+	for _, span := range spans {
+		if got := span.SpanContext().TraceID().String(); got != traceID {
+			t.Errorf("span %s has trace id %s, want the propagated %s", span.Name(), got, traceID)
+		}
+		byName[span.Name()] = append(byName[span.Name()], span)
+	}
+
+	if len(byName["request"]) != 1 {
+		t.Fatalf("got %d request spans, want 1", len(byName["request"]))
+	}
+	request := byName["request"][0]
+	if got := request.Parent().SpanID().String(); got != parentSpanID || !request.Parent().IsRemote() {
+		t.Errorf("request span's parent is %s, want the remote %s", got, parentSpanID)
+	}
+	if v, _ := spanAttribute(request, "request.id"); v.AsString() != "traced" {
+		t.Errorf("request.id = %q", v.AsString())
+	}
+	if v, _ := spanAttribute(request, "request.outcome"); v.AsString() != outcomeFailed {
+		t.Errorf("request.outcome = %q, want %q", v.AsString(), outcomeFailed)
+	}
+
+	for _, name := range []string{"queue", "receive_test_suite", "receive_source_code", "init_checks", "stage compile"} {
+		if len(byName[name]) != 1 {
+			t.Errorf("got %d %q spans, want 1", len(byName[name]), name)
+			continue
+		}
+		if byName[name][0].Parent().SpanID() != request.SpanContext().SpanID() {
+			t.Errorf("%q span isn't a child of the request span", name)
+		}
+	}
+
+	// one span per test case
+	testCases := byName["stage run_tests"]
+	if len(testCases) != 2 {
+		t.Fatalf("got %d test case spans, want 2", len(testCases))
+	}
+	for i, span := range testCases {
+		if span.Parent().SpanID() != request.SpanContext().SpanID() {
+			t.Errorf("test case %d span isn't a child of the request span", i)
+		}
+		if v, ok := spanAttribute(span, "stage.test_case"); !ok || v.AsInt64() != int64(i) {
+			t.Errorf("test case span %d has stage.test_case %v", i, v.Emit())
+		}
+		if v, ok := spanAttribute(span, "limits.run_time_sec"); !ok || v.AsFloat64() != 5 {
+			t.Errorf("test case span %d has limits.run_time_sec %v", i, v.Emit())
+		}
+	}
+
+	// output sent after the program exited belongs to the stage which printed it
+	stageSpans := make(map[string]bool)
+	for _, span := range append(byName["stage compile"], testCases...) {
+		stageSpans[span.SpanContext().SpanID().String()] = true
+	}
+	for _, span := range byName["flush_output"] {
+		if !stageSpans[span.Parent().SpanID().String()] {
+			t.Error("flush_output span isn't a child of a stage span")
+		}
+	}
+}
+
+func TestContextWithTraceParent(t *testing.T) {
+	recorder := useTestWorker(t)
+
+	ctx := contextWithTraceParent(t.Context(), "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "vendor=value")
+	_, span := tracer.Start(ctx, "request")
+	span.End()
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, want 1", len(spans))
+	}
+	sc := spans[0].SpanContext()
+	if sc.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || spans[0].Parent().SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("span doesn't continue the trace: trace %s, parent %s", sc.TraceID(), spans[0].Parent().SpanID())
+	}
+	if got := sc.TraceState().Get("vendor"); got != "value" {
+		t.Errorf("tracestate vendor = %q, want value", got)
+	}
+
+	// without traceparent a new trace starts
+	_, span = tracer.Start(contextWithTraceParent(t.Context(), "", ""), "request")
+	span.End()
+	if spans := recorder.Ended(); spans[1].Parent().IsValid() {
+		t.Error("span without traceparent has a parent")
+	}
+}
@@ -0,0 +1,106 @@
+package rules
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Diff describes changes between two sets of build envs
+type Diff struct {
+	AddedEnvs   []string
+	RemovedEnvs []string
+	ChangedEnvs []EnvDiff
+}
+
+type EnvDiff struct {
+	Name          string
+	AddedStages   []string
+	RemovedStages []string
+	ChangedStages []string
+}
+
+func (d Diff) Empty() bool {
+	return len(d.AddedEnvs) == 0 && len(d.RemovedEnvs) == 0 && len(d.ChangedEnvs) == 0
+}
+
+func (d Diff) String() string {
+	if d.Empty() {
+		return "no changes"
+	}
+	parts := []string{}
+	if len(d.AddedEnvs) != 0 {
+		parts = append(parts, "added envs: "+strings.Join(d.AddedEnvs, ", "))
+	}
+	if len(d.RemovedEnvs) != 0 {
+		parts = append(parts, "removed envs: "+strings.Join(d.RemovedEnvs, ", "))
+	}
+	for _, env := range d.ChangedEnvs {
+		changes := []string{}
+		if len(env.AddedStages) != 0 {
+			changes = append(changes, "added stages: "+strings.Join(env.AddedStages, ", "))
+		}
+		if len(env.RemovedStages) != 0 {
+			changes = append(changes, "removed stages: "+strings.Join(env.RemovedStages, ", "))
+		}
+		if len(env.ChangedStages) != 0 {
+			changes = append(changes, "changed stages: "+strings.Join(env.ChangedStages, ", "))
+		}
+		parts = append(parts, fmt.Sprintf("env %s (%s)", env.Name, strings.Join(changes, "; ")))
+	}
+	return strings.Join(parts, "; ")
+}
+
+func diffBuildEnvs(oldEnvs map[string]*BuildStages, newEnvs map[string]*BuildStages) Diff {
+	diff := Diff{}
+	for name, newEnv := range newEnvs {
+		oldEnv, ok := oldEnvs[name]
+		if !ok {
+			diff.AddedEnvs = append(diff.AddedEnvs, name)
+			continue
+		}
+		if envDiff := diffStages(oldEnv, newEnv); envDiff != nil {
+			diff.ChangedEnvs = append(diff.ChangedEnvs, *envDiff)
+		}
+	}
+	for name := range oldEnvs {
+		if _, ok := newEnvs[name]; !ok {
+			diff.RemovedEnvs = append(diff.RemovedEnvs, name)
+		}
+	}
+	sort.Strings(diff.AddedEnvs)
+	sort.Strings(diff.RemovedEnvs)
+	sort.Slice(diff.ChangedEnvs, func(i, j int) bool { return diff.ChangedEnvs[i].Name < diff.ChangedEnvs[j].Name })
+	return diff
+}
+
+// diffStages returns nil if stages of both envs are the same
+func diffStages(oldEnv *BuildStages, newEnv *BuildStages) *EnvDiff {
+	diff := EnvDiff{Name: newEnv.Name}
+	for _, newStage := range newEnv.Stages {
+		oldStage, ok := oldEnv.StageMap[newStage.Name]
+		if !ok {
+			diff.AddedStages = append(diff.AddedStages, newStage.Name)
+		} else if !sameStage(oldStage, &newStage) {
+			diff.ChangedStages = append(diff.ChangedStages, newStage.Name)
+		}
+	}
+	for _, oldStage := range oldEnv.Stages {
+		if _, ok := newEnv.StageMap[oldStage.Name]; !ok {
+			diff.RemovedStages = append(diff.RemovedStages, oldStage.Name)
+		}
+	}
+	if len(diff.AddedStages) == 0 && len(diff.RemovedStages) == 0 && len(diff.ChangedStages) == 0 {
+		return nil
+	}
+	return &diff
+}
+
+// sameStage compares stages ignoring where they are defined
+func sameStage(a *Stage, b *Stage) bool {
+	aCopy, bCopy := *a, *b
+	aCopy.Pos, bCopy.Pos = Position{}, Position{}
+	aCopy.fieldPos, bCopy.fieldPos = nil, nil
+	return reflect.DeepEqual(aCopy, bCopy)
+}
@@ -0,0 +1,77 @@
+package rules
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Position of a definition in a rules file
+type Position struct {
+	File   string
+	Line   int
+	Column int
+}
+
+func (p Position) String() string {
+	if p.Line == 0 {
+		return p.File
+	} else if p.Column == 0 {
+		return fmt.Sprintf("%s:%d", p.File, p.Line)
+	}
+	return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Column)
+}
+
+// Errors collects every problem found in rules files, so all of them can be reported at once
+type Errors []error
+
+func (e Errors) Error() string {
+	lines := make([]string, 0, len(e))
+	for _, err := range e {
+		lines = append(lines, err.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (e *Errors) add(pos Position, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if prefix := pos.String(); prefix != "" {
+		msg = prefix + ": " + msg
+	}
+	*e = append(*e, fmt.Errorf("%s", msg))
+}
+
+// addErr adds an error flattening it if it's Errors itself
+func (e *Errors) addErr(err error) {
+	if errs, ok := err.(Errors); ok {
+		*e = append(*e, errs...)
+	} else if err != nil {
+		*e = append(*e, err)
+	}
+}
+
+// Err returns nil if there are no errors
+func (e Errors) Err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// addYAMLError adds an error reported by the yaml decoder, they look like "line 5: field x not found in type y"
+func (e *Errors) addYAMLError(file string, msg string) {
+	pos := Position{File: file}
+	msg = strings.TrimPrefix(msg, "yaml: ")
+	if strings.HasPrefix(msg, "line ") {
+		parts := strings.SplitN(strings.TrimPrefix(msg, "line "), ": ", 2)
+		if line, err := strconv.Atoi(parts[0]); err == nil && len(parts) == 2 {
+			pos.Line = line
+			msg = parts[1]
+		}
+	}
+	// "field x not found in type rules.stageSpec" mentions internal types
+	if strings.HasPrefix(msg, "field ") && strings.Contains(msg, " not found in type ") {
+		msg = fmt.Sprintf("unknown key %q", strings.TrimPrefix(msg[:strings.Index(msg, " not found in type ")], "field "))
+	}
+	e.add(pos, "%s", msg)
+}
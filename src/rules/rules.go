@@ -2,10 +2,14 @@ package rules
 
 import (
 	"fmt"
-	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
 
 	log "github.com/sirupsen/logrus"
-	"gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
 )
 
 type Limits struct {
@@ -17,61 +21,244 @@ type Limits struct {
 	Output          uint64  `yaml:"output_bytes"`     // bytes
 }
 
+// StageNames can be written in yaml either as a single name or as a list of names
+type StageNames []string
+
+func (n *StageNames) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		var name string
+		if err := value.Decode(&name); err != nil {
+			return err
+		}
+		if name == "" {
+			*n = nil
+		} else {
+			*n = StageNames{name}
+		}
+		return nil
+	}
+	var names []string
+	if err := value.Decode(&names); err != nil {
+		return err
+	}
+	*n = names
+	return nil
+}
+
 type Stage struct {
-	Name      string   `yaml:"name"`
-	Command   string   `yaml:"command"`
-	DependsOn string   `yaml:"depends_on"`
-	Env       []string `yaml:"env"`
-	Mounts    []string `yaml:"mounts"`
-	Limits    *Limits  `yaml:"limits"`
+	Name      string     `yaml:"name"`
+	Command   string     `yaml:"command"`
+	DependsOn StageNames `yaml:"depends_on"`
+	Env       []string   `yaml:"env"`
+	Mounts    []string   `yaml:"mounts"`
+	Limits    *Limits    `yaml:"limits"`
+	// the pipeline goes on even if this stage fails
+	ContinueOnFailure bool `yaml:"continue_on_failure"`
+	// the stage runs even if some previous stage failed, ex: cleanup or report stages
+	AlwaysRun bool `yaml:"always_run"`
+	// exit codes meaning success, [0] if empty
+	AllowedExitCodes []int `yaml:"allowed_exit_codes"`
+
+	// where the stage is defined
+	Pos Position `yaml:"-"`
+	// where fields are defined, including inherited ones, ex: "mounts", "limits.run_time_sec"
+	fieldPos map[string]Position
+}
+
+// PosOf returns position of the field definition, or of the stage itself if the field isn't set explicitly
+func (s *Stage) PosOf(field string) Position {
+	if pos, ok := s.fieldPos[field]; ok {
+		return pos
+	}
+	return s.Pos
+}
+
+// ExitCodeAllowed tells whether the stage succeeded with the given exit code
+func (s *Stage) ExitCodeAllowed(exitCode int) bool {
+	if len(s.AllowedExitCodes) == 0 {
+		return exitCode == 0
+	}
+	for _, code := range s.AllowedExitCodes {
+		if code == exitCode {
+			return true
+		}
+	}
+	return false
 }
 
 type BuildStages struct {
+	Name     string  `yaml:"-"` // name of the build env, taken from the file name
 	Stages   []Stage `yaml:"stages"`
 	StageMap map[string]*Stage
 }
 
-var buildStages *BuildStages = nil
+// loaded build envs, map[string]*BuildStages keyed by name
+// the map is never modified after being stored, reloading swaps it as a whole
+var buildEnvs atomic.Value
 
-//
-func StagesForTarget(target string) ([]*Stage, error) {
-	curTarget := target
+func loadedBuildEnvs() map[string]*BuildStages {
+	envs, _ := buildEnvs.Load().(map[string]*BuildStages)
+	return envs
+}
+
+// BuildEnv returns the loaded build env with the given name
+func BuildEnv(name string) (*BuildStages, error) {
+	bs, ok := loadedBuildEnvs()[name]
+	if !ok {
+		return nil, fmt.Errorf("build env %s is not loaded", name)
+	}
+	return bs, nil
+}
+
+// BuildEnvNames returns sorted names of all loaded build envs
+func BuildEnvNames() []string {
+	envs := loadedBuildEnvs()
+	names := make([]string, 0, len(envs))
+	for name := range envs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Targets returns names of all stages in the order they are declared
+func (r *BuildStages) Targets() []string {
+	targets := make([]string, 0, len(r.Stages))
+	for _, stage := range r.Stages {
+		targets = append(targets, stage.Name)
+	}
+	return targets
+}
+
+// StagesForTarget returns stages needed to build the target in topological order:
+// every stage goes after all of its dependencies, the target is the last one
+func (r *BuildStages) StagesForTarget(target string) ([]*Stage, error) {
 	result := make([]*Stage, 0)
+	visited := make(map[string]bool)
 
-	for curTarget != "" {
-		stage, ok := buildStages.StageMap[curTarget]
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		stage, ok := r.StageMap[name]
 		if !ok {
-			return nil, fmt.Errorf("target %s is not found", curTarget)
+			return fmt.Errorf("target %s is not found", name)
 		}
-		result = append([]*Stage{stage}, result...)
-
-		if stage.DependsOn == target {
-			return nil, fmt.Errorf("circular reference to itself at stage %s found", stage.Name)
+		for i, prev := range path {
+			if prev == name {
+				return fmt.Errorf("circular dependency found: %s", strings.Join(append(path[i:], name), " -> "))
+			}
 		}
-		if len(result) > 64 {
-			return nil, fmt.Errorf("to many stages are dependants of the target %s, circular reference?", target)
+		if visited[name] {
+			return nil
 		}
+		path = append(path, name)
+		for _, dep := range stage.DependsOn {
+			if err := visit(dep, path); err != nil {
+				return err
+			}
+		}
+		visited[name] = true
+		result = append(result, stage)
+		return nil
+	}
 
-		curTarget = stage.DependsOn
+	if err := visit(target, nil); err != nil {
+		return nil, err
 	}
 	return result, nil
 }
 
+// Layers splits topologically sorted stages into layers, where stages of the same layer
+// don't depend on each other and can be run in parallel once all previous layers are done
+func Layers(stages []*Stage) [][]*Stage {
+	depths := make(map[string]int)
+	layers := make([][]*Stage, 0)
+
+	for _, stage := range stages {
+		depth := 0
+		for _, dep := range stage.DependsOn {
+			if d, ok := depths[dep]; ok && d+1 > depth {
+				depth = d + 1
+			}
+		}
+		depths[stage.Name] = depth
+		if depth == len(layers) {
+			layers = append(layers, nil)
+		}
+		layers[depth] = append(layers[depth], stage)
+	}
+	return layers
+}
+
+// Check validates every stage and returns all found problems as Errors
 func (r *BuildStages) Check() error {
+	errs := Errors{}
+	if len(r.Stages) == 0 {
+		errs.add(Position{}, "no stages defined in build env '%s'", r.Name)
+	}
+
+	names := make(map[string]Position)
+	duplicated := make(map[string]bool)
 	for _, stage := range r.Stages {
+		if _, ok := names[stage.Name]; ok {
+			duplicated[stage.Name] = true
+		}
+		names[stage.Name] = stage.Pos
+	}
+
+	names = make(map[string]Position)
+	for i := range r.Stages {
+		stage := &r.Stages[i]
 		if stage.Name == "" {
-			return fmt.Errorf("Stage.Name can't be empty, stage '%s'", stage.Name)
+			errs.add(stage.Pos, "Stage.Name can't be empty, stage '%s'", stage.Name)
 		} else if stage.Name == "init" {
-			return fmt.Errorf("Stage.Name can't be 'init', stage '%s'", stage.Name)
+			errs.add(stage.PosOf("name"), "Stage.Name can't be 'init', stage '%s'", stage.Name)
+		} else if pos, ok := names[stage.Name]; ok {
+			errs.add(stage.PosOf("name"), "Stage.Name must be unique, stage '%s' is already defined at %s", stage.Name, pos)
 		}
+		names[stage.Name] = stage.Pos
+
 		if stage.Command == "" {
-			return fmt.Errorf("Command can't be empty, stage '%s'", stage.Name)
+			errs.add(stage.PosOf("command"), "Command can't be empty, stage '%s'", stage.Name)
+		}
+
+		dependsOnKnown := true
+		for _, dep := range stage.DependsOn {
+			if _, ok := r.StageMap[dep]; !ok {
+				errs.add(stage.PosOf("depends_on"), "Stage.DependsOn refers to unknown stage '%s', stage '%s'", dep, stage.Name)
+				dependsOnKnown = false
+			}
+		}
+		if dependsOnKnown && !duplicated[stage.Name] {
+			if _, err := r.StagesForTarget(stage.Name); err != nil {
+				errs.add(stage.PosOf("depends_on"), "%v, stage '%s'", err, stage.Name)
+			}
+		}
+
+		for _, mount := range stage.Mounts {
+			// nsjail accepts "src" or "src:dst"
+			src := strings.SplitN(mount, ":", 2)[0]
+			if strings.HasPrefix(src, "{out}") {
+				continue // the request's output directory exists only while the request runs
+			}
+			if _, err := os.Stat(src); err != nil {
+				errs.add(stage.PosOf("mounts"), "Stage.Mounts path %s doesn't exist, stage '%s'", src, stage.Name)
+			}
+		}
+
+		for _, code := range stage.AllowedExitCodes {
+			if code < 0 || code > 255 {
+				errs.add(stage.PosOf("allowed_exit_codes"), "Stage.AllowedExitCodes has invalid exit code %d, stage '%s'", code, stage.Name)
+			}
 		}
 
 		limits := stage.Limits
+		if limits == nil {
+			errs.add(stage.Pos, "Stage.Limits must be set, stage '%s'", stage.Name)
+			continue
+		}
 
 		if limits.AddressSpace == 0 {
-			return fmt.Errorf("Limit.AddressSpace can't be zero, stage '%s'", stage.Name)
+			errs.add(stage.PosOf("limits.address_space_mb"), "Limit.AddressSpace can't be zero, stage '%s'", stage.Name)
 		} else if limits.AddressSpace < 64 {
 			log.Warningf("Limit.AddressSpace %d mb seems very low, stage '%s'\n", limits.AddressSpace, stage.Name)
 		} else if limits.AddressSpace > 512 {
@@ -79,7 +266,7 @@ func (r *BuildStages) Check() error {
 		}
 
 		if limits.RunTime == 0.0 {
-			return fmt.Errorf("Limit.RunTime can't be zero, stage '%s'", stage.Name)
+			errs.add(stage.PosOf("limits.run_time_sec"), "Limit.RunTime can't be zero, stage '%s'", stage.Name)
 		} else if limits.RunTime < 0.5 {
 			log.Warningf("Limit.RunTime %.1f sec seems very low, stage '%s'\n", limits.RunTime, stage.Name)
 		} else if limits.RunTime > 60.0 {
@@ -87,7 +274,7 @@ func (r *BuildStages) Check() error {
 		}
 
 		if limits.FileDescriptors == 0 {
-			return fmt.Errorf("Limit.FileDescriptors can't be zero, stage '%s'", stage.Name)
+			errs.add(stage.PosOf("limits.file_descriptors"), "Limit.FileDescriptors can't be zero, stage '%s'", stage.Name)
 		} else if limits.FileDescriptors < 3 {
 			log.Warningf("Limit.FileDescriptors %d seems very low, stage '%s'\n", limits.FileDescriptors, stage.Name)
 		} else if limits.FileDescriptors > 512 {
@@ -95,7 +282,7 @@ func (r *BuildStages) Check() error {
 		}
 
 		if limits.FileWrites == 0 {
-			return fmt.Errorf("Limit.FileWrites can't be zero, stage '%s'", stage.Name)
+			errs.add(stage.PosOf("limits.file_writes_mb"), "Limit.FileWrites can't be zero, stage '%s'", stage.Name)
 		} else if limits.FileWrites < 1 {
 			log.Warningf("Limit.FileWrites %d mb seems very low, stage '%s'\n", limits.FileWrites, stage.Name)
 		} else if limits.FileWrites > 100 {
@@ -103,7 +290,7 @@ func (r *BuildStages) Check() error {
 		}
 
 		if limits.Threads == 0 {
-			return fmt.Errorf("Limit.Threads can't be zero, stage '%s'", stage.Name)
+			errs.add(stage.PosOf("limits.threads"), "Limit.Threads can't be zero, stage '%s'", stage.Name)
 		} else if limits.Threads < 64 {
 			log.Warningf("Limit.Threads %d seems very low, stage '%s'\n", limits.Threads, stage.Name)
 		} else if limits.Threads > 2000 {
@@ -111,40 +298,113 @@ func (r *BuildStages) Check() error {
 		}
 
 		if limits.Output == 0 {
-			return fmt.Errorf("Limit.Output can't be zero, stage '%s'", stage.Name)
+			errs.add(stage.PosOf("limits.output_bytes"), "Limit.Output can't be zero, stage '%s'", stage.Name)
 		} else if limits.Output < 1024 {
 			log.Warningf("Limit.Output %d bytes seems very low, stage '%s'\n", limits.Output, stage.Name)
 		} else if limits.Output > 1024*1024*1024 { // 1 mb
 			log.Warningf("Limit.Output %d bytes seems too high, stage '%s'\n", limits.Output, stage.Name)
 		}
 	}
-	return nil
+	return errs.Err()
 }
 
-func LoadBuildStages(filesDir string, buildEnvName string) error {
+func LoadBuildStages(filesDir string, buildEnvName string) (*BuildStages, error) {
 	filePath := filesDir + "/" + buildEnvName + ".yml"
-	bytes, err := ioutil.ReadFile(filePath)
-	if err != nil {
-		return fmt.Errorf("failed to read build stages file %s: %v", filePath, err)
-	}
 
-	bs := &BuildStages{}
+	// schema errors, like unknown keys, don't hide other problems: what was decoded is still checked
+	errs := Errors{}
+	rf, err := readRulesFile(filePath, nil)
+	errs.addErr(err)
+	if rf == nil {
+		return nil, errs
+	}
 
-	err = yaml.Unmarshal(bytes, bs)
+	stages, err := rf.resolveStages()
 	if err != nil {
-		return fmt.Errorf("failed to unmarshal build stages file %s: %w", filePath, err)
+		// stages which failed to resolve are missing, checking the rest would report them as unknown
+		errs.addErr(err)
+		return nil, errs
 	}
+	bs := &BuildStages{Name: buildEnvName, Stages: stages}
 
 	bs.StageMap = make(map[string]*Stage)
 	for i, stage := range bs.Stages {
 		bs.StageMap[stage.Name] = &bs.Stages[i]
 	}
 
-	err = bs.Check()
+	errs.addErr(bs.Check())
+	if len(errs) != 0 {
+		return nil, errs
+	}
+	return bs, nil
+}
+
+// ListBuildEnvs returns sorted names of all build envs (.yml files) in the rules directory,
+// files starting with '_' are shared fragments for including and aren't build envs
+func ListBuildEnvs(filesDir string) ([]string, error) {
+	filePaths, err := filepath.Glob(filepath.Join(filesDir, "*.yml"))
 	if err != nil {
-		return fmt.Errorf("error in build stages file %s: %w", filePath, err)
+		return nil, fmt.Errorf("failed to list build stages files in %s: %v", filesDir, err)
+	}
+	names := make([]string, 0, len(filePaths))
+	for _, filePath := range filePaths {
+		fileName := filepath.Base(filePath)
+		if strings.HasPrefix(fileName, "_") {
+			continue
+		}
+		names = append(names, strings.TrimSuffix(fileName, ".yml"))
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func loadBuildEnvs(filesDir string, names []string) (map[string]*BuildStages, error) {
+	if len(names) == 0 {
+		var err error
+		names, err = ListBuildEnvs(filesDir)
+		if err != nil {
+			return nil, err
+		}
+		if len(names) == 0 {
+			return nil, fmt.Errorf("no build stages files found in %s", filesDir)
+		}
 	}
 
-	buildStages = bs
+	// load every env to report errors of all of them at once
+	errs := Errors{}
+	envs := make(map[string]*BuildStages)
+	for _, name := range names {
+		bs, err := LoadBuildStages(filesDir, name)
+		if err != nil {
+			errs.addErr(err)
+			continue
+		}
+		envs[name] = bs
+	}
+	if len(errs) != 0 {
+		return nil, errs
+	}
+	return envs, nil
+}
+
+// LoadBuildEnvs loads the given build envs from the rules directory, or every build env in it if names is empty
+func LoadBuildEnvs(filesDir string, names []string) error {
+	envs, err := loadBuildEnvs(filesDir, names)
+	if err != nil {
+		return err
+	}
+	buildEnvs.Store(envs)
 	return nil
 }
+
+// ReloadBuildEnvs loads build envs the same way as LoadBuildEnvs and swaps them with the active ones
+// only if all of them are valid. Requests which already got their BuildStages keep using the old rules.
+func ReloadBuildEnvs(filesDir string, names []string) (Diff, error) {
+	envs, err := loadBuildEnvs(filesDir, names)
+	if err != nil {
+		return Diff{}, err
+	}
+	diff := diffBuildEnvs(loadedBuildEnvs(), envs)
+	buildEnvs.Store(envs)
+	return diff, nil
+}
@@ -0,0 +1,230 @@
+package rules
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testLimits = "{address_space_mb: 100, run_time_sec: 1, file_descriptors: 10, file_writes_mb: 1, threads: 100, output_bytes: 2000}"
+
+// writeRulesDir writes rules files into a temporary directory, "LIMITS" in their texts is replaced with valid limits
+func writeRulesDir(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, text := range files {
+		text = strings.ReplaceAll(text, "LIMITS", testLimits)
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(text), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func stageNames(stages []*Stage) []string {
+	names := []string{}
+	for _, stage := range stages {
+		names = append(names, stage.Name)
+	}
+	return names
+}
+
+func TestStagesForTarget(t *testing.T) {
+	dir := writeRulesDir(t, map[string]string{"env.yml": `
+stages:
+  - {name: compile_solution, command: a, limits: LIMITS}
+  - {name: compile_harness, command: b, limits: LIMITS}
+  - {name: link, command: c, depends_on: [compile_solution, compile_harness], limits: LIMITS}
+  - {name: run_tests, command: d, depends_on: link, limits: LIMITS}
+  - {name: lint, command: e, limits: LIMITS}
+`})
+	bs, err := LoadBuildStages(dir, "env")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		target string
+		stages []string
+		layers [][]string
+	}{
+		{"compile_harness", []string{"compile_harness"}, [][]string{{"compile_harness"}}},
+		{"link", []string{"compile_solution", "compile_harness", "link"}, [][]string{{"compile_solution", "compile_harness"}, {"link"}}},
+		{"run_tests", []string{"compile_solution", "compile_harness", "link", "run_tests"},
+			[][]string{{"compile_solution", "compile_harness"}, {"link"}, {"run_tests"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			stages, err := bs.StagesForTarget(tt.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := stageNames(stages); !reflect.DeepEqual(got, tt.stages) {
+				t.Errorf("stages = %v, want %v", got, tt.stages)
+			}
+			layers := [][]string{}
+			for _, layer := range Layers(stages) {
+				layers = append(layers, stageNames(layer))
+			}
+			if !reflect.DeepEqual(layers, tt.layers) {
+				t.Errorf("layers = %v, want %v", layers, tt.layers)
+			}
+		})
+	}
+
+	if _, err := bs.StagesForTarget("nope"); err == nil {
+		t.Error("unknown target: expected an error")
+	}
+}
+
+func TestDependencyCycles(t *testing.T) {
+	tests := []struct {
+		name   string
+		stages string
+		errs   []string
+	}{
+		{
+			name: "self",
+			stages: `
+  - {name: a, command: a, depends_on: a, limits: LIMITS}`,
+			errs: []string{"circular dependency found: a -> a"},
+		},
+		{
+			name: "loop of three",
+			stages: `
+  - {name: a, command: a, depends_on: c, limits: LIMITS}
+  - {name: b, command: b, depends_on: a, limits: LIMITS}
+  - {name: c, command: c, depends_on: b, limits: LIMITS}
+  - {name: d, command: d, limits: LIMITS}`,
+			errs: []string{
+				"circular dependency found: a -> c -> b -> a, stage 'a'",
+				"circular dependency found: b -> a -> c -> b, stage 'b'",
+				"circular dependency found: c -> b -> a -> c, stage 'c'",
+			},
+		},
+		{
+			name: "cycle behind a diamond",
+			stages: `
+  - {name: a, command: a, depends_on: d, limits: LIMITS}
+  - {name: b, command: b, depends_on: a, limits: LIMITS}
+  - {name: c, command: c, depends_on: a, limits: LIMITS}
+  - {name: d, command: d, depends_on: [b, c], limits: LIMITS}`,
+			errs: []string{"circular dependency found: a -> d -> b -> a"},
+		},
+		{
+			name: "diamond isn't a cycle",
+			stages: `
+  - {name: a, command: a, limits: LIMITS}
+  - {name: b, command: b, depends_on: a, limits: LIMITS}
+  - {name: c, command: c, depends_on: a, limits: LIMITS}
+  - {name: d, command: d, depends_on: [b, c], limits: LIMITS}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeRulesDir(t, map[string]string{"env.yml": "stages:" + tt.stages + "\n"})
+			_, err := LoadBuildStages(dir, "env")
+			if len(tt.errs) == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			for _, want := range tt.errs {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q doesn't mention %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadReportsAllErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		errs []string
+	}{
+		{
+			name: "unknown key doesn't hide other errors",
+			text: `stages:
+  - name: compile
+    command: gcc
+    mounts": ["/"]
+    limits: LIMITS
+  - name: run
+    depends_on: nope
+    command: ""
+    limits: {address_space_mb: 100, run_time_sec: 1, file_descriptors: 0, file_writes_mb: 1, threads: 100, output_bytes: 2000}
+  - name: compile
+    command: gcc
+`,
+			errs: []string{
+				`env.yml:4: unknown key "mounts\""`,
+				"env.yml:7:5: Stage.DependsOn refers to unknown stage 'nope', stage 'run'",
+				"env.yml:8:5: Command can't be empty, stage 'run'",
+				"env.yml:9:54: Limit.FileDescriptors can't be zero, stage 'run'",
+				"env.yml:10:5: Stage.Name must be unique, stage 'compile' is already defined at",
+				"env.yml:10:5: Stage.Limits must be set, stage 'compile'",
+			},
+		},
+		{
+			name: "wrong types",
+			text: `stages:
+  - name: run
+    command: [a, b]
+    limits: {address_space_mb: 100, run_time_sec: 1, file_descriptors: 10, file_writes_mb: 1, threads: many, output_bytes: 2000}
+`,
+			errs: []string{
+				"env.yml:3: cannot unmarshal !!seq into string",
+				"env.yml:4: cannot unmarshal !!str `many` into uint64",
+				// fields which failed to decode stay empty
+				"env.yml:3:5: Command can't be empty, stage 'run'",
+				"env.yml:4:95: Limit.Threads can't be zero, stage 'run'",
+			},
+		},
+		{
+			name: "invalid mounts and exit codes",
+			text: `stages:
+  - name: run
+    command: a
+    mounts: ["/nonexistent/dir:/dir", "{out}"]
+    allowed_exit_codes: [0, 300]
+    limits: LIMITS
+`,
+			errs: []string{
+				"env.yml:4:5: Stage.Mounts path /nonexistent/dir doesn't exist, stage 'run'",
+				"env.yml:5:5: Stage.AllowedExitCodes has invalid exit code 300, stage 'run'",
+			},
+		},
+		{
+			name: "syntax error",
+			text: "stages:\n  - name: [\n",
+			errs: []string{"env.yml:2: did not find expected node content"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeRulesDir(t, map[string]string{"env.yml": tt.text})
+			_, err := LoadBuildStages(dir, "env")
+			errs, ok := err.(Errors)
+			if !ok {
+				t.Fatalf("expected Errors, got %v", err)
+			}
+			if len(errs) != len(tt.errs) {
+				t.Errorf("got %d errors, want %d:\n%v", len(errs), len(tt.errs), errs)
+			}
+			for _, want := range tt.errs {
+				if !strings.Contains(errs.Error(), want) {
+					t.Errorf("errors don't mention %q:\n%v", want, errs)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,310 @@
+package rules
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// limitsSpec is Limits as written in a rules file,
+// unset fields are taken from the profile or from the extended stage
+type limitsSpec struct {
+	Profile         string   `yaml:"profile"`
+	AddressSpace    *uint64  `yaml:"address_space_mb"`
+	RunTime         *float32 `yaml:"run_time_sec"`
+	FileDescriptors *uint64  `yaml:"file_descriptors"`
+	FileWrites      *uint64  `yaml:"file_writes_mb"`
+	Threads         *uint64  `yaml:"threads"`
+	Output          *uint64  `yaml:"output_bytes"`
+
+	keyPos map[string]Position
+}
+
+// stageSpec is Stage as written in a rules file, unset fields are taken from the extended stage
+type stageSpec struct {
+	Name              string      `yaml:"name"`
+	Extends           string      `yaml:"extends"`
+	Command           *string     `yaml:"command"`
+	DependsOn         *StageNames `yaml:"depends_on"`
+	Env               *[]string   `yaml:"env"`
+	Mounts            *[]string   `yaml:"mounts"`
+	Limits            *limitsSpec `yaml:"limits"`
+	ContinueOnFailure *bool       `yaml:"continue_on_failure"`
+	AlwaysRun         *bool       `yaml:"always_run"`
+	AllowedExitCodes  *[]int      `yaml:"allowed_exit_codes"`
+
+	pos    Position
+	keyPos map[string]Position
+}
+
+// rulesFile is the content of a build env file or of a shared fragment included by it.
+// Templates can't be run, they only serve as a base for stages with `extends`.
+type rulesFile struct {
+	Include       []string               `yaml:"include"`
+	LimitProfiles map[string]*limitsSpec `yaml:"limit_profiles"`
+	Templates     []stageSpec            `yaml:"templates"`
+	Stages        []stageSpec            `yaml:"stages"`
+}
+
+// mappingValue returns the value node for the key, or nil if the node isn't a mapping or has no such key
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// keyPositions returns positions of all keys of a mapping node, keys of nested mappings are prefixed with "<key>."
+func keyPositions(file string, node *yaml.Node, prefix string, positions map[string]Position) map[string]Position {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return positions
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key := node.Content[i]
+		positions[prefix+key.Value] = Position{File: file, Line: key.Line, Column: key.Column}
+		keyPositions(file, node.Content[i+1], prefix+key.Value+".", positions)
+	}
+	return positions
+}
+
+func nodePosition(file string, node *yaml.Node) Position {
+	return Position{File: file, Line: node.Line, Column: node.Column}
+}
+
+// setStagePositions fills positions of stage specs from the sequence node they were decoded from
+func setStagePositions(file string, node *yaml.Node, specs []stageSpec) {
+	if node == nil || node.Kind != yaml.SequenceNode || len(node.Content) != len(specs) {
+		return
+	}
+	for i, item := range node.Content {
+		specs[i].pos = nodePosition(file, item)
+		specs[i].keyPos = keyPositions(file, item, "", make(map[string]Position))
+		if specs[i].Limits != nil {
+			specs[i].Limits.keyPos = keyPositions(file, mappingValue(item, "limits"), "limits.", make(map[string]Position))
+		}
+	}
+}
+
+// decodeRulesFile strictly decodes a rules file: unknown or duplicated keys and wrong types are errors.
+// They don't stop decoding, so the file is returned along with them and can be checked further,
+// the file is nil only if it isn't valid YAML at all.
+func decodeRulesFile(filePath string, data []byte) (*rulesFile, error) {
+	rf := &rulesFile{}
+
+	errs := Errors{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err := decoder.Decode(rf)
+	if err == io.EOF {
+		return rf, nil // empty file
+	}
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		for _, msg := range typeErr.Errors {
+			errs.addYAMLError(filePath, msg)
+		}
+	} else if err != nil {
+		errs.addYAMLError(filePath, err.Error())
+		return nil, errs
+	}
+
+	// decode once more to get positions of definitions
+	root := yaml.Node{}
+	err = yaml.Unmarshal(data, &root)
+	if err != nil || len(root.Content) == 0 {
+		return rf, errs.Err()
+	}
+	doc := root.Content[0]
+	setStagePositions(filePath, mappingValue(doc, "stages"), rf.Stages)
+	setStagePositions(filePath, mappingValue(doc, "templates"), rf.Templates)
+	profilesNode := mappingValue(doc, "limit_profiles")
+	for name, profile := range rf.LimitProfiles {
+		profileNode := mappingValue(profilesNode, name)
+		if profile == nil || profileNode == nil {
+			continue
+		}
+		profile.keyPos = keyPositions(filePath, profileNode, "limits.", make(map[string]Position))
+	}
+	return rf, errs.Err()
+}
+
+// readRulesFile reads a rules file and merges in files it includes (paths are relative to the file),
+// definitions from the file itself take precedence over included ones.
+// Like decodeRulesFile it returns what it could read along with errors, nil if there's nothing to check.
+func readRulesFile(filePath string, includedFrom []string) (*rulesFile, error) {
+	for _, path := range includedFrom {
+		if path == filePath {
+			return nil, fmt.Errorf("circular include: %s -> %s", strings.Join(includedFrom, " -> "), filePath)
+		}
+	}
+
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read build stages file %s: %v", filePath, err)
+	}
+
+	errs := Errors{}
+	rf, err := decodeRulesFile(filePath, data)
+	errs.addErr(err)
+	if rf == nil {
+		return nil, errs
+	}
+
+	merged := &rulesFile{LimitProfiles: make(map[string]*limitsSpec), Stages: rf.Stages}
+	for _, include := range rf.Include {
+		includePath := filepath.Join(filepath.Dir(filePath), include)
+		included, err := readRulesFile(includePath, append(includedFrom, filePath))
+		errs.addErr(err)
+		if included == nil {
+			continue
+		}
+		if len(included.Stages) != 0 {
+			errs.add(included.Stages[0].pos, "included file can't have stages, only limit_profiles and templates")
+		}
+		for name, profile := range included.LimitProfiles {
+			merged.LimitProfiles[name] = profile
+		}
+		merged.Templates = append(merged.Templates, included.Templates...)
+	}
+	for name, profile := range rf.LimitProfiles {
+		merged.LimitProfiles[name] = profile
+	}
+	merged.Templates = append(merged.Templates, rf.Templates...)
+	return merged, errs.Err()
+}
+
+// resolveStages applies `extends` and limit profiles, the result has every inherited field filled in
+func (rf *rulesFile) resolveStages() ([]Stage, error) {
+	// stages can extend templates or other stages, later definitions win
+	bases := make(map[string]*stageSpec)
+	for i := range rf.Templates {
+		bases[rf.Templates[i].Name] = &rf.Templates[i]
+	}
+	for i := range rf.Stages {
+		bases[rf.Stages[i].Name] = &rf.Stages[i]
+	}
+
+	var resolve func(spec *stageSpec, chain []string) (Stage, error)
+	resolve = func(spec *stageSpec, chain []string) (Stage, error) {
+		stage := Stage{fieldPos: make(map[string]Position)}
+		if spec.Extends != "" {
+			for _, name := range chain {
+				if name == spec.Extends {
+					return stage, fmt.Errorf("circular extends: %s -> %s", strings.Join(chain, " -> "), spec.Extends)
+				}
+			}
+			base, ok := bases[spec.Extends]
+			if !ok {
+				return stage, fmt.Errorf("stage '%s' extends unknown stage or template '%s'", spec.Name, spec.Extends)
+			}
+			var err error
+			stage, err = resolve(base, append(chain, spec.Extends))
+			if err != nil {
+				return stage, err
+			}
+		}
+
+		stage.Name = spec.Name
+		stage.Pos = spec.pos
+		for key, pos := range spec.keyPos {
+			stage.fieldPos[key] = pos
+		}
+		if spec.Command != nil {
+			stage.Command = *spec.Command
+		}
+		if spec.DependsOn != nil {
+			stage.DependsOn = *spec.DependsOn
+		}
+		if spec.Env != nil {
+			stage.Env = *spec.Env
+		}
+		if spec.Mounts != nil {
+			stage.Mounts = *spec.Mounts
+		}
+		if spec.Limits != nil {
+			limits, err := rf.resolveLimits(spec.Limits, stage.Limits, stage.fieldPos)
+			if err != nil {
+				return stage, fmt.Errorf("%v, stage '%s'", err, spec.Name)
+			}
+			stage.Limits = limits
+		}
+		if spec.ContinueOnFailure != nil {
+			stage.ContinueOnFailure = *spec.ContinueOnFailure
+		}
+		if spec.AlwaysRun != nil {
+			stage.AlwaysRun = *spec.AlwaysRun
+		}
+		if spec.AllowedExitCodes != nil {
+			stage.AllowedExitCodes = *spec.AllowedExitCodes
+		}
+		return stage, nil
+	}
+
+	errs := Errors{}
+	stages := make([]Stage, 0, len(rf.Stages))
+	for i := range rf.Stages {
+		stage, err := resolve(&rf.Stages[i], []string{rf.Stages[i].Name})
+		if err != nil {
+			errs.add(rf.Stages[i].pos, "%v", err)
+			continue
+		}
+		stages = append(stages, stage)
+	}
+	return stages, errs.Err()
+}
+
+// resolveLimits overrides base limits with the profile and then with explicitly set fields,
+// fieldPos gets positions of the limits taken from the profile
+func (rf *rulesFile) resolveLimits(spec *limitsSpec, base *Limits, fieldPos map[string]Position) (*Limits, error) {
+	limits := Limits{}
+	if base != nil {
+		limits = *base
+	}
+	if spec.Profile != "" {
+		profile, ok := rf.LimitProfiles[spec.Profile]
+		if !ok || profile == nil {
+			return nil, fmt.Errorf("unknown limit profile '%s'", spec.Profile)
+		}
+		if profile.Profile != "" {
+			return nil, fmt.Errorf("limit profile '%s' can't refer to another profile", spec.Profile)
+		}
+		applyLimits(&limits, profile)
+		for key, pos := range profile.keyPos {
+			if _, ok := spec.keyPos[key]; !ok {
+				fieldPos[key] = pos
+			}
+		}
+	}
+	applyLimits(&limits, spec)
+	return &limits, nil
+}
+
+func applyLimits(limits *Limits, spec *limitsSpec) {
+	if spec.AddressSpace != nil {
+		limits.AddressSpace = *spec.AddressSpace
+	}
+	if spec.RunTime != nil {
+		limits.RunTime = *spec.RunTime
+	}
+	if spec.FileDescriptors != nil {
+		limits.FileDescriptors = *spec.FileDescriptors
+	}
+	if spec.FileWrites != nil {
+		limits.FileWrites = *spec.FileWrites
+	}
+	if spec.Threads != nil {
+		limits.Threads = *spec.Threads
+	}
+	if spec.Output != nil {
+		limits.Output = *spec.Output
+	}
+}
@@ -0,0 +1,181 @@
+package rules
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestResolveExtendsAndInclude(t *testing.T) {
+	dir := writeRulesDir(t, map[string]string{
+		"_common.yml": `
+limit_profiles:
+  small: LIMITS
+  big: {address_space_mb: 500, run_time_sec: 10, file_descriptors: 100, file_writes_mb: 10, threads: 1000, output_bytes: 100000}
+templates:
+  - name: gcc
+    command: "g++ main.cpp"
+    mounts: ["/"]
+    limits: {profile: small}
+`,
+		"env.yml": `
+include: [_common.yml]
+limit_profiles:
+  big: {address_space_mb: 400, run_time_sec: 5, file_descriptors: 50, file_writes_mb: 5, threads: 500, output_bytes: 50000}
+stages:
+  - name: compile
+    extends: gcc
+  - name: compile_tests
+    extends: compile
+    command: "g++ tests.cpp"
+    limits: {run_time_sec: 3}
+  - name: run
+    command: "./a.out"
+    depends_on: compile
+    limits: {profile: big, threads: 64}
+`,
+	})
+	bs, err := LoadBuildStages(dir, "env")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	small := Limits{AddressSpace: 100, RunTime: 1, FileDescriptors: 10, FileWrites: 1, Threads: 100, Output: 2000}
+	tests := []struct {
+		stage   string
+		command string
+		mounts  []string
+		limits  Limits
+	}{
+		{"compile", "g++ main.cpp", []string{"/"}, small},
+		{"compile_tests", "g++ tests.cpp", []string{"/"}, Limits{AddressSpace: 100, RunTime: 3, FileDescriptors: 10, FileWrites: 1, Threads: 100, Output: 2000}},
+		// the env's own profile overrides the included one with the same name
+		{"run", "./a.out", nil, Limits{AddressSpace: 400, RunTime: 5, FileDescriptors: 50, FileWrites: 5, Threads: 64, Output: 50000}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.stage, func(t *testing.T) {
+			stage, ok := bs.StageMap[tt.stage]
+			if !ok {
+				t.Fatalf("stage %s isn't loaded", tt.stage)
+			}
+			if stage.Command != tt.command {
+				t.Errorf("command = %q, want %q", stage.Command, tt.command)
+			}
+			if !reflect.DeepEqual(stage.Mounts, tt.mounts) {
+				t.Errorf("mounts = %v, want %v", stage.Mounts, tt.mounts)
+			}
+			if *stage.Limits != tt.limits {
+				t.Errorf("limits = %+v, want %+v", *stage.Limits, tt.limits)
+			}
+		})
+	}
+
+	// templates aren't targets
+	if got, want := bs.Targets(), []string{"compile", "compile_tests", "run"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("targets = %v, want %v", got, want)
+	}
+}
+
+func TestResolveErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		err   string
+	}{
+		{
+			name: "circular extends",
+			files: map[string]string{"env.yml": `
+templates:
+  - {name: t1, extends: t2, command: a, limits: LIMITS}
+  - {name: t2, extends: t1}
+stages:
+  - {name: a, extends: t1}
+`},
+			err: "circular extends: a -> t1 -> t2 -> t1",
+		},
+		{
+			name: "stage extends itself",
+			files: map[string]string{"env.yml": `
+stages:
+  - {name: a, extends: a, command: a, limits: LIMITS}
+`},
+			err: "circular extends: a -> a",
+		},
+		{
+			name: "unknown base",
+			files: map[string]string{"env.yml": `
+stages:
+  - {name: a, extends: nope}
+`},
+			err: "stage 'a' extends unknown stage or template 'nope'",
+		},
+		{
+			name: "unknown profile",
+			files: map[string]string{"env.yml": `
+stages:
+  - {name: a, command: a, limits: {profile: nope}}
+`},
+			err: "unknown limit profile 'nope', stage 'a'",
+		},
+		{
+			name: "profile refers to profile",
+			files: map[string]string{"env.yml": `
+limit_profiles:
+  base: LIMITS
+  derived: {profile: base}
+stages:
+  - {name: a, command: a, limits: {profile: derived}}
+`},
+			err: "limit profile 'derived' can't refer to another profile",
+		},
+		{
+			name: "circular include",
+			files: map[string]string{
+				"env.yml": `
+include: [_a.yml]
+stages:
+  - {name: a, command: a, limits: LIMITS}
+`,
+				"_a.yml": "include: [_b.yml]\n",
+				"_b.yml": "include: [_a.yml]\n",
+			},
+			err: "circular include",
+		},
+		{
+			name: "missing include",
+			files: map[string]string{"env.yml": `
+include: [_nope.yml]
+stages:
+  - {name: a, command: a, limits: LIMITS}
+`},
+			err: "failed to read build stages file",
+		},
+		{
+			name: "included file with stages",
+			files: map[string]string{
+				"env.yml": `
+include: [_a.yml]
+stages:
+  - {name: a, command: a, limits: LIMITS}
+`,
+				"_a.yml": `
+stages:
+  - {name: b, command: b, limits: LIMITS}
+`,
+			},
+			err: "_a.yml:3:5: included file can't have stages",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeRulesDir(t, tt.files)
+			_, err := LoadBuildStages(dir, "env")
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error %q doesn't mention %q", err, tt.err)
+			}
+		})
+	}
+}
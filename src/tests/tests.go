@@ -8,6 +8,9 @@ import (
 	"github.com/practicode-org/worker/src/api"
 )
 
+// CheckTypes lists types of checks: exit_code is checked for test cases, the others for init test cases
+var CheckTypes = []string{"exit_code", "text_contains", "text_excludes"}
+
 func CheckExitCode(check api.TestCheck, exitCode int) (bool, error) {
 	if check.Type == "exit_code" {
 		desiredExitCode, err := strconv.Atoi(check.Arg)
@@ -1,13 +1,21 @@
 package main
 
 import (
+	"crypto/hmac"
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -19,11 +27,68 @@ type SourceFile struct {
 }
 
 type ClientMessage struct {
-	SourceFiles []SourceFile `json:"source_files"`
+	SourceFiles []SourceFile `json:"source_files,omitempty"`
+	RequestID   string       `json:"request_id"`
+	Requester   string       `json:"requester,omitempty"`
+	Target      string       `json:"target,omitempty"`
+	BuildEnv    string       `json:"build_env,omitempty"`
+	Timestamp   int64        `json:"timestamp,omitempty"`
+	Signature   string       `json:"signature,omitempty"`
+	SourcesHash string       `json:"sources_hash,omitempty"`
 }
 
 var addr = flag.String("addr", "ws://localhost:1556/run?build_env=cpp-generic", "worker ws address")
-var inputFile = flag.String("input", "", "")
+var inputFile = flag.String("input", "", "source code file")
+var target = flag.String("target", "run", "target stage")
+var testsFile = flag.String("tests", "", "test suite JSON file, for test targets")
+var token = flag.String("token", "", "bearer token, if the worker requires one")
+var secret = flag.String("secret", "", "secret to sign the request with, if the worker requires signed requests")
+var requester = flag.String("requester", "", "who sends the request, it's written to the worker's audit log")
+
+// every message is wrapped into an envelope
+type Envelope struct {
+	Type    string          `json:"type"`
+	Version int             `json:"version"`
+	Seq     uint64          `json:"seq"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+const protocolVersion = 1
+
+var seq uint64
+
+func writeMessage(c *websocket.Conn, msgType string, payload []byte) {
+	seq++
+	jtext, err := json.Marshal(Envelope{Type: msgType, Version: protocolVersion, Seq: seq, Payload: payload})
+	if err != nil {
+		log.Fatal("Failed to json marshal:", err)
+	}
+	err = c.WriteMessage(websocket.TextMessage, jtext)
+	if err != nil {
+		log.Fatal("Failed to ws write:", err)
+	}
+}
+
+func writeJSON(c *websocket.Conn, msgType string, msg interface{}) {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		log.Fatal("Failed to json marshal:", err)
+	}
+	writeMessage(c, msgType, payload)
+}
+
+func readMessage(c *websocket.Conn) (Envelope, []byte) {
+	_, message, err := c.ReadMessage()
+	if err != nil {
+		log.Fatal("Failed to ws read:", err)
+	}
+	env := Envelope{}
+	err = json.Unmarshal(message, &env)
+	if err != nil {
+		log.Fatal("Failed to Unmarshal JSON message:", err)
+	}
+	return env, message
+}
 
 func main() {
 	flag.Parse()
@@ -33,59 +98,72 @@ func main() {
 		log.Fatal("Failed to open source code file:", err)
 	}
 
-	c, _, err := websocket.DefaultDialer.Dial(*addr, nil)
+	header := http.Header{}
+	if *token != "" {
+		header.Set("Authorization", "Bearer "+*token)
+	}
+	c, _, err := websocket.DefaultDialer.Dial(*addr, header)
 	if err != nil {
 		log.Fatal("Failed to dial:", err)
 	}
 	defer c.Close()
 
-	encodedText := base64.StdEncoding.EncodeToString(text)
-
-	msg := ClientMessage{SourceFiles: []SourceFile{SourceFile{Name: "src0",
-		Text: encodedText,
-		Hash: fmt.Sprintf("%x", md5.Sum([]byte(text)))}}}
-
-	jtext, err := json.Marshal(msg)
-	if err != nil {
-		log.Fatal("Failed to json marshal:", err)
+	// the worker starts with a hello listing supported protocol versions, answer with the one we speak
+	env, message := readMessage(c)
+	if env.Type != "hello" {
+		log.Fatal("Expected hello, got:", string(message))
+	}
+	writeJSON(c, "hello", struct {
+		Versions []int `json:"versions"`
+	}{[]int{protocolVersion}})
+
+	requestID := fmt.Sprintf("client-%d", time.Now().UnixNano())
+	newMsg := ClientMessage{RequestID: requestID, Requester: *requester, Target: *target}
+	if *secret != "" {
+		newMsg.Timestamp = time.Now().Unix()
+		// the signature covers the sources: "<name>\n<hex SHA-256 of the text>\n" of every file
+		sourcesHash := sha256.New()
+		fmt.Fprintf(sourcesHash, "%s\n%x\n", filepath.Base(*inputFile), sha256.Sum256(text))
+		newMsg.SourcesHash = hex.EncodeToString(sourcesHash.Sum(nil))
+		mac := hmac.New(sha256.New, []byte(*secret))
+		mac.Write([]byte(strings.Join([]string{newMsg.RequestID, newMsg.Requester, newMsg.BuildEnv, newMsg.Target, strconv.FormatInt(newMsg.Timestamp, 10), newMsg.SourcesHash}, "\n")))
+		newMsg.Signature = hex.EncodeToString(mac.Sum(nil))
 	}
+	writeJSON(c, "new", newMsg)
 
-	err = c.WriteMessage(websocket.TextMessage, jtext)
-	if err != nil {
-		log.Fatal("Failed to ws write:", err)
+	if *testsFile != "" {
+		tests, err := ioutil.ReadFile(*testsFile)
+		if err != nil {
+			log.Fatal("Failed to open test suite file:", err)
+		}
+		writeMessage(c, "test_suite", tests)
 	}
 
-	done := make(chan struct{})
+	encodedText := base64.StdEncoding.EncodeToString(text)
+	writeJSON(c, "source_files", ClientMessage{RequestID: requestID, SourceFiles: []SourceFile{SourceFile{Name: filepath.Base(*inputFile),
+		Text: encodedText,
+		Hash: fmt.Sprintf("%x", md5.Sum([]byte(text)))}}})
 
-	go func() {
-		defer close(done)
-		for {
-			_, message, err := c.ReadMessage()
-			if err != nil {
-				log.Println("Failed to ws read:", err)
-				return
-			}
+	for {
+		env, message := readMessage(c)
 
+		switch env.Type {
+		case "output":
 			msg := struct {
 				Output string `json:"output"`
 			}{}
-			err = json.Unmarshal(message, &msg)
+			json.Unmarshal(env.Payload, &msg)
+			outputDecoded, err := base64.StdEncoding.DecodeString(msg.Output)
 			if err != nil {
-				log.Println("Failed to Unmarshal JSON message:", err)
-			}
-
-			if msg.Output != "" {
-				outputDecoded, err := base64.StdEncoding.DecodeString(msg.Output)
-				if err != nil {
-					log.Println("Failed to Decode base64:", err)
-					continue
-				}
-				log.Printf("Output: %s", string(outputDecoded))
-			} else {
-				fmt.Println("Message:", string(message))
+				log.Println("Failed to Decode base64:", err)
+				continue
 			}
+			log.Printf("Output: %s", string(outputDecoded))
+		case "finish":
+			fmt.Println("Message:", string(message))
+			return
+		default:
+			fmt.Println("Message:", string(message))
 		}
-	}()
-
-	<-done
+	}
 }